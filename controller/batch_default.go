@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package controller
+
+import (
+	"net"
+)
+
+/* Fallback without batched system calls,
+ * moves a single datagram per call
+ */
+
+type udpBatch struct{}
+
+func newUDPBatch(conn *net.UDPConn) *udpBatch {
+	return &udpBatch{}
+}
+
+func (batch *udpBatch) receive(conn *net.UDPConn, buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	return receiveSingle(conn, buffers, sizes, addrs)
+}
+
+func (batch *udpBatch) send(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+	return sendSingle(conn, packets, addr)
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Batched UDP I/O with recvmmsg and sendmmsg
+ *
+ * ipv4.Message and ipv6.Message are the same type,
+ * the packet conn is picked by the family of the socket.
+ */
+
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type udpBatch struct {
+	conn batchConn
+	rx   []ipv4.Message // used by the single receiving routine only
+	tx   struct {
+		mutex    sync.Mutex
+		messages []ipv4.Message
+	}
+}
+
+func newUDPBatch(conn *net.UDPConn) *udpBatch {
+	batch := new(udpBatch)
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && laddr.IP.To4() != nil {
+		batch.conn = ipv4.NewPacketConn(conn)
+	} else {
+		batch.conn = ipv6.NewPacketConn(conn)
+	}
+	batch.rx = newBatchMessages(UDPBatchSize)
+	batch.tx.messages = newBatchMessages(UDPBatchSize)
+	return batch
+}
+
+func newBatchMessages(size int) []ipv4.Message {
+	messages := make([]ipv4.Message, size)
+	for i := range messages {
+		messages[i].Buffers = make([][]byte, 1)
+	}
+	return messages
+}
+
+func (batch *udpBatch) receive(conn *net.UDPConn, buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	count := len(buffers)
+	if count > len(batch.rx) {
+		count = len(batch.rx)
+	}
+	messages := batch.rx[:count]
+	for i := range messages {
+		messages[i].Buffers[0] = buffers[i]
+		messages[i].Addr = nil
+		messages[i].N = 0
+	}
+
+	n, err := batch.conn.ReadBatch(messages, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		sizes[i] = messages[i].N
+		addrs[i], _ = messages[i].Addr.(*net.UDPAddr)
+	}
+	return n, nil
+}
+
+/* Writes the packets to addr, or to the connected endpoint when addr is nil
+ */
+func (batch *udpBatch) send(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+	batch.tx.mutex.Lock()
+	defer batch.tx.mutex.Unlock()
+
+	var dst net.Addr
+	if addr != nil {
+		dst = addr
+	}
+
+	sent := 0
+	for sent < len(packets) {
+		count := len(packets) - sent
+		if count > len(batch.tx.messages) {
+			count = len(batch.tx.messages)
+		}
+		messages := batch.tx.messages[:count]
+		for i := range messages {
+			messages[i].Buffers[0] = packets[sent+i]
+			messages[i].Addr = dst
+		}
+
+		n, err := batch.conn.WriteBatch(messages, 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,452 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* Transport recording the messages sent, failing after limit messages
+ * when limit is positive, and receiving the scripted messages
+ */
+type testTransport struct {
+	sent     [][]byte
+	addrs    []*net.UDPAddr
+	limit    int
+	received [][]byte
+	source   *net.UDPAddr
+}
+
+func (t *testTransport) write(packet []byte, addr *net.UDPAddr) (int, error) {
+	if t.limit > 0 && len(t.sent) >= t.limit {
+		return 0, errors.New("no buffer space available")
+	}
+	t.sent = append(t.sent, append([]byte{}, packet...))
+	t.addrs = append(t.addrs, addr)
+	return len(packet), nil
+}
+
+func (t *testTransport) Send(packet []byte) (int, error) {
+	return t.write(packet, nil)
+}
+
+func (t *testTransport) SendTo(packet []byte, addr *net.UDPAddr) (int, error) {
+	return t.write(packet, addr)
+}
+
+func (t *testTransport) Receive(buffer []byte) (int, *net.UDPAddr, error) {
+	if len(t.received) == 0 {
+		return 0, nil, errors.New("use of closed network connection")
+	}
+	n := copy(buffer, t.received[0])
+	t.received = t.received[1:]
+	return n, t.source, nil
+}
+
+func (t *testTransport) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func (t *testTransport) Close() error {
+	return nil
+}
+
+func (t *testTransport) Name() string {
+	return "test"
+}
+
+/* Batch transport on top of testTransport, receiving at most batch messages per call
+ */
+type testBatchTransport struct {
+	testTransport
+	batch   int
+	batches int
+}
+
+func (t *testBatchTransport) ReceiveBatch(buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	if len(t.received) == 0 {
+		return 0, errors.New("use of closed network connection")
+	}
+	t.batches++
+	n := 0
+	for n < len(buffers) && n < t.batch && len(t.received) > 0 {
+		sizes[n], addrs[n], _ = t.Receive(buffers[n])
+		n++
+	}
+	return n, nil
+}
+
+func (t *testBatchTransport) SendBatch(packets [][]byte, addr *net.UDPAddr) (int, error) {
+	t.batches++
+	for i, packet := range packets {
+		if _, err := t.write(packet, addr); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+type xorObfuscator byte
+
+func (x xorObfuscator) Obfuscate(packet []byte) []byte {
+	for i := range packet {
+		packet[i] ^= byte(x)
+	}
+	return packet
+}
+
+func (x xorObfuscator) Deobfuscate(packet []byte) []byte {
+	return x.Obfuscate(packet)
+}
+
+func (x xorObfuscator) Junk() [][]byte {
+	return nil
+}
+
+func testPackets(count int) [][]byte {
+	packets := make([][]byte, count)
+	for i := range packets {
+		packets[i] = bytes.Repeat([]byte{byte(i)}, 64+i)
+	}
+	return packets
+}
+
+func TestSendBuffers(t *testing.T) {
+	endpoint := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	for _, test := range []struct {
+		name      string
+		transport Transport
+		peerOwned bool
+		limit     int
+		sent      int
+	}{
+		{name: "single", transport: &testTransport{}, sent: 5},
+		{name: "batch", transport: &testBatchTransport{}, sent: 5},
+		{name: "peer", transport: &testBatchTransport{}, peerOwned: true, sent: 5},
+		{name: "single failing", transport: &testTransport{limit: 3}, sent: 3},
+		{name: "batch failing", transport: &testBatchTransport{testTransport: testTransport{limit: 3}}, sent: 3},
+	} {
+		device := newTestDevice(DefaultMTU)
+		device.SetObfuscator(xorObfuscator(0x5a))
+		peer := &Peer{device: device}
+		if test.peerOwned {
+			peer.transport = test.transport
+			peer.endpoint = endpoint
+		} else {
+			device.net.transport = test.transport
+		}
+
+		packets := testPackets(5)
+		n, err := peer.SendBuffers(testPackets(5))
+		if n != test.sent || (err != nil) != (test.sent < len(packets)) {
+			t.Errorf("%s: sent %d, %v, want %d", test.name, n, err, test.sent)
+			continue
+		}
+
+		var recorder *testTransport
+		switch transport := test.transport.(type) {
+		case *testTransport:
+			recorder = transport
+		case *testBatchTransport:
+			recorder = &transport.testTransport
+			if transport.batches != 1 {
+				t.Errorf("%s: %d batches, want 1", test.name, transport.batches)
+			}
+		}
+		for i, message := range recorder.sent {
+			if !bytes.Equal(xorObfuscator(0x5a).Deobfuscate(message), packets[i]) {
+				t.Errorf("%s: message %d differs", test.name, i)
+			}
+			if test.peerOwned != (recorder.addrs[i] == endpoint) {
+				t.Errorf("%s: message %d sent to %v", test.name, i, recorder.addrs[i])
+			}
+		}
+
+		var bytes uint64
+		for _, packet := range packets[:n] {
+			bytes += uint64(len(packet))
+		}
+		if atomic.LoadUint64(&device.counters.txPackets) != uint64(n) || atomic.LoadUint64(&device.counters.txBytes) != bytes {
+			t.Errorf("%s: counted %d packets, %d bytes", test.name, device.counters.txPackets, device.counters.txBytes)
+		}
+	}
+}
+
+func TestSendBuffersWithoutTransport(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	peer := &Peer{device: device}
+	if n, err := peer.SendBuffers(testPackets(2)); n != 0 || err == nil {
+		t.Errorf("sent %d, %v without a transport", n, err)
+	}
+}
+
+func TestHandleBatchTransport(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+
+	initiation := make([]byte, MessageInitiationV0Size)
+	binary.LittleEndian.PutUint32(initiation, MessageInitiationType)
+	cookie := make([]byte, MessageCookieReplySize)
+	binary.LittleEndian.PutUint32(cookie, MessageCookieReplyType)
+	runt := []byte{1, 2, 3}
+	unknown := make([]byte, MessageCookieReplySize)
+	binary.LittleEndian.PutUint32(unknown, 99)
+
+	// more messages than fit in one batch, 2*UDPBatchSize+2 handshake messages
+	var received [][]byte
+	for i := 0; i < UDPBatchSize+1; i++ {
+		received = append(received, initiation, runt, cookie, unknown)
+	}
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	transport := &testBatchTransport{
+		testTransport: testTransport{received: received, source: source},
+		batch:         UDPBatchSize,
+	}
+
+	want := 2 * (UDPBatchSize + 1)
+	device.queue.handshake = make(chan QueueHandshakeElement, want)
+	device.handleBatchTransport(transport)
+
+	var handshakes []QueueHandshakeElement
+	for len(device.queue.handshake) > 0 {
+		handshakes = append(handshakes, <-device.queue.handshake)
+	}
+	if len(handshakes) != want {
+		t.Fatalf("%d handshake messages queued, want %d", len(handshakes), want)
+	}
+	if transport.batches != len(received)/UDPBatchSize+1 {
+		t.Errorf("%d batches read", transport.batches)
+	}
+	buffers := make(map[*[MaxMessageSize]byte]bool)
+	for i, elem := range handshakes {
+		wantType := uint32(MessageInitiationType)
+		if i%2 == 1 {
+			wantType = MessageCookieReplyType
+		}
+		if elem.msgType != wantType || elem.source != source || elem.transport != transport {
+			t.Errorf("message %d: type %d from %v", i, elem.msgType, elem.source)
+		}
+		if buffers[elem.buffer] {
+			t.Fatalf("message %d shares its buffer with an earlier one", i)
+		}
+		buffers[elem.buffer] = true
+	}
+
+	// only the queued buffers are still taken
+	if n := device.memory.InFlight(); n != want {
+		t.Errorf("%d buffers in flight, want %d", n, want)
+	}
+}
+
+/* Connected client and listening server on the loopback
+ */
+func udpPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+/* Sends packets with send and reads them back with receive, in order
+ */
+func checkUDPBatch(t *testing.T, name string,
+	send func(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error),
+	receive func(conn *net.UDPConn, buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error),
+) {
+	client, server := udpPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	server.SetDeadline(time.Now().Add(time.Second * 5))
+
+	buffers := make([][]byte, UDPBatchSize)
+	for i := range buffers {
+		buffers[i] = make([]byte, MaxMessageSize)
+	}
+	sizes := make([]int, UDPBatchSize)
+	addrs := make([]*net.UDPAddr, UDPBatchSize)
+
+	for _, direction := range []struct {
+		from, to *net.UDPConn
+		addr     *net.UDPAddr
+	}{
+		{client, server, nil},                               // connected endpoint
+		{server, client, client.LocalAddr().(*net.UDPAddr)}, // reply to the source
+	} {
+		packets := testPackets(UDPBatchSize + 5)
+		n, err := send(direction.from, packets, direction.addr)
+		if n != len(packets) || err != nil {
+			t.Fatalf("%s: sent %d of %d: %v", name, n, len(packets), err)
+		}
+
+		next := 0
+		for next < len(packets) {
+			n, err := receive(direction.to, buffers, sizes, addrs)
+			if err != nil {
+				t.Fatalf("%s: received %d of %d: %v", name, next, len(packets), err)
+			}
+			for i := 0; i < n; i++ {
+				if !bytes.Equal(buffers[i][:sizes[i]], packets[next]) {
+					t.Fatalf("%s: datagram %d differs", name, next)
+				}
+				if from := direction.from.LocalAddr().(*net.UDPAddr); addrs[i] == nil || addrs[i].Port != from.Port {
+					t.Fatalf("%s: datagram %d from %v, want %v", name, next, addrs[i], from)
+				}
+				next++
+			}
+		}
+	}
+}
+
+func TestUDPBatch(t *testing.T) {
+	checkUDPBatch(t, "batch",
+		func(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+			return newUDPBatch(conn).send(conn, packets, addr)
+		},
+		func(conn *net.UDPConn, buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+			return newUDPBatch(conn).receive(conn, buffers, sizes, addrs)
+		},
+	)
+}
+
+func TestUDPSingle(t *testing.T) {
+	checkUDPBatch(t, "single", sendSingle, receiveSingle)
+}
+
+func TestUDPTransportBatch(t *testing.T) {
+	client, server := udpPair(t)
+	defer client.Close()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(time.Second * 5))
+
+	// the connected endpoint given as address is sent to as connected
+	transport := newUDPTransport(client)
+	packets := testPackets(3)
+	if n, err := transport.SendBatch(packets, server.LocalAddr().(*net.UDPAddr)); n != len(packets) || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	buffer := make([]byte, MaxMessageSize)
+	for i := range packets {
+		n, _, err := server.ReadFromUDP(buffer)
+		if err != nil || !bytes.Equal(buffer[:n], packets[i]) {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+	}
+}
+
+/* Throughput of sending 1420 byte datagrams over the loopback,
+ * batched (sendmmsg on Linux) and one system call per datagram
+ */
+func BenchmarkUDPSend(b *testing.B) {
+	for _, mode := range []string{"batch", "single"} {
+		b.Run(mode, func(b *testing.B) {
+			client, server := udpPair(b)
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				buffer := make([]byte, MaxMessageSize)
+				for {
+					if _, err := server.Read(buffer); err != nil {
+						return
+					}
+				}
+			}()
+
+			batch := newUDPBatch(client)
+			packets := make([][]byte, UDPBatchSize)
+			for i := range packets {
+				packets[i] = make([]byte, DefaultMTU)
+			}
+
+			b.SetBytes(DefaultMTU)
+			b.ResetTimer()
+			for sent := 0; sent < b.N; sent += len(packets) {
+				if b.N-sent < len(packets) {
+					packets = packets[:b.N-sent]
+				}
+				var err error
+				if mode == "batch" {
+					_, err = batch.send(client, packets, nil)
+				} else {
+					_, err = sendSingle(client, packets, nil)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+/* Throughput of receiving datagrams over the loopback, batched
+ * (recvmmsg on Linux) and one system call per datagram
+ */
+func BenchmarkUDPReceive(b *testing.B) {
+	for _, mode := range []string{"batch", "single"} {
+		b.Run(mode, func(b *testing.B) {
+			client, server := udpPair(b)
+			defer client.Close()
+			defer server.Close()
+			server.SetReadBuffer(1 << 22)
+
+			buffers := make([][]byte, UDPBatchSize)
+			for i := range buffers {
+				buffers[i] = make([]byte, MaxMessageSize)
+			}
+			sizes := make([]int, UDPBatchSize)
+			addrs := make([]*net.UDPAddr, UDPBatchSize)
+			batch := newUDPBatch(server)
+
+			// a datagram is sent only after one was received,
+			// keeping a window in flight without losses
+			window := make(chan struct{}, 256)
+			for i := 0; i < cap(window) && i < b.N; i++ {
+				window <- struct{}{}
+			}
+			go func() {
+				packet := make([]byte, DefaultMTU)
+				for i := 0; i < b.N; i++ {
+					<-window
+					if _, err := client.Write(packet); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(DefaultMTU)
+			b.ResetTimer()
+			for received := 0; received < b.N; {
+				server.SetReadDeadline(time.Now().Add(time.Second * 5))
+				var n int
+				var err error
+				if mode == "batch" {
+					n, err = batch.receive(server, buffers, sizes, addrs)
+				} else {
+					n, err = receiveSingle(server, buffers, sizes, addrs)
+				}
+				if err != nil {
+					b.Fatal("received " + strconv.Itoa(received) + ": " + err.Error())
+				}
+				received += n
+				for i := 0; i < n; i++ {
+					select {
+					case window <- struct{}{}:
+					default:
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"bt/logger"
+)
+
+/* Captures the plaintext inner packets to a pcap file
+ *
+ * Outbound packets are captured after being read from the TUN device,
+ * inbound packets before being written to the TUN device.
+ * The file uses LINKTYPE_RAW (packets begin with the IP header).
+ * Records are buffered and written to the file when the buffer is full,
+ * once per flush interval and when the capture stops, so that the data
+ * plane does not make a syscall per packet.
+ */
+
+const (
+	PcapMagic          = 0xa1b2c3d4
+	PcapVersionMajor   = 2
+	PcapVersionMinor   = 4
+	PcapSnapLen        = 65535
+	PcapLinkTypeRaw    = 101
+	PcapHeaderSize     = 24
+	PcapRecordSize     = 16
+	DefaultCaptureSize = 10 << 20 // 10 MiB
+	CaptureBufferSize  = 64 << 10
+	CaptureFlushPeriod = time.Second
+)
+
+type PacketCapture struct {
+	active  AtomicBool
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	flushed time.Time
+	written int64
+	limit   int64
+}
+
+func (capture *PacketCapture) Start(path string, limit int64) error {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.file != nil {
+		return errors.New("capture already running")
+	}
+	if limit <= 0 {
+		limit = DefaultCaptureSize
+	}
+	if limit < PcapHeaderSize+PcapRecordSize {
+		return errors.New("capture size limit too small")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var header [PcapHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], PcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], PcapVersionMajor)
+	binary.LittleEndian.PutUint16(header[6:8], PcapVersionMinor)
+	binary.LittleEndian.PutUint32(header[16:20], PcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], PcapLinkTypeRaw)
+	if _, err := file.Write(header[:]); err != nil {
+		file.Close()
+		return err
+	}
+
+	capture.file = file
+	capture.writer = bufio.NewWriterSize(file, CaptureBufferSize)
+	capture.flushed = time.Now()
+	capture.written = PcapHeaderSize
+	capture.limit = limit
+	capture.active.Set(true)
+
+	logger.Wlog.SaveInfoLog("packet capture started:" + path)
+	return nil
+}
+
+func (capture *PacketCapture) Stop() error {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	return capture.stopLocked()
+}
+
+/* Caller must hold the capture mutex
+ */
+func (capture *PacketCapture) stopLocked() error {
+	capture.active.Set(false)
+	if capture.file == nil {
+		return nil
+	}
+	err := capture.writer.Flush()
+	if cerr := capture.file.Close(); err == nil {
+		err = cerr
+	}
+	capture.file = nil
+	capture.writer = nil
+	logger.Wlog.SaveInfoLog("packet capture stopped")
+	return err
+}
+
+/* Appends a packet to the capture,
+ * the capture stops once the size limit would be exceeded
+ */
+func (capture *PacketCapture) Write(packet []byte) {
+	if !capture.active.Get() {
+		return
+	}
+
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.file == nil {
+		return
+	}
+
+	size := len(packet)
+	if size > PcapSnapLen {
+		size = PcapSnapLen
+	}
+	if capture.written+PcapRecordSize+int64(size) > capture.limit {
+		capture.stopLocked()
+		return
+	}
+
+	var record [PcapRecordSize]byte
+	now := time.Now()
+	binary.LittleEndian.PutUint32(record[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(size))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+
+	_, err := capture.writer.Write(record[:])
+	if err == nil {
+		_, err = capture.writer.Write(packet[:size])
+	}
+	if err == nil && now.Sub(capture.flushed) >= CaptureFlushPeriod {
+		err = capture.writer.Flush()
+		capture.flushed = now
+	}
+	if err != nil {
+		logger.Wlog.SaveErrLog("Failed to write packet capture:" + err.Error())
+		capture.stopLocked()
+		return
+	}
+	capture.written += PcapRecordSize + int64(size)
+}
+
+func (device *Device) StartCapture(path string, limit int64) error {
+	return device.capture.Start(path, limit)
+}
+
+func (device *Device) StopCapture() error {
+	return device.capture.Stop()
+}
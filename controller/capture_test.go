@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPacketCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pcap")
+
+	var capture PacketCapture
+	if err := capture.Start(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	packets := [][]byte{make([]byte, 20), make([]byte, 1280)}
+	for _, packet := range packets {
+		packet[0] = 0x45
+		capture.Write(packet)
+	}
+	if err := capture.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < PcapHeaderSize || binary.LittleEndian.Uint32(data) != PcapMagic {
+		t.Fatal("missing pcap header")
+	}
+	data = data[PcapHeaderSize:]
+	for i, packet := range packets {
+		if len(data) < PcapRecordSize {
+			t.Fatalf("record %d missing", i)
+		}
+		size := int(binary.LittleEndian.Uint32(data[8:12]))
+		if size != len(packet) || int(binary.LittleEndian.Uint32(data[12:16])) != len(packet) {
+			t.Fatalf("record %d of %d bytes, want %d", i, size, len(packet))
+		}
+		data = data[PcapRecordSize:]
+		if len(data) < size || data[0] != 0x45 {
+			t.Fatalf("record %d truncated", i)
+		}
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		t.Errorf("%d trailing bytes", len(data))
+	}
+}
+
+func TestPacketCaptureLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pcap")
+
+	var capture PacketCapture
+	limit := int64(PcapHeaderSize + 2*(PcapRecordSize+100))
+	if err := capture.Start(path, limit); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		capture.Write(make([]byte, 100))
+	}
+	if capture.active.Get() {
+		t.Fatal("capture still running past its limit")
+	}
+
+	// stopped by the limit, the buffered records are on disk
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != limit {
+		t.Errorf("capture of %d bytes, want %d", info.Size(), limit)
+	}
+}
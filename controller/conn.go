@@ -4,8 +4,6 @@ import (
 	"bt/logger"
 	"errors"
 	"net"
-
-	"golang.org/x/sys/windows"
 )
 
 func parseEndpoint(s string) (*net.UDPAddr, error) {
@@ -32,10 +30,23 @@ func createUDPConn(device *Device, raddr *net.UDPAddr) (int, error) {
 	defer netc.mutex.Unlock()
 
 	// close existing connection
-	if netc.conn != nil {
-		logger.Wlog.SaveInfoLog("断开旧的udp连接:" + netc.conn.LocalAddr().String())
-		go netc.conn.Close()
-		netc.conn = nil
+	if netc.transport != nil {
+		logger.Wlog.SaveInfoLog("断开旧的连接:" + netc.transport.LocalAddr().String())
+		go netc.transport.Close()
+		netc.transport = nil
+	}
+
+	// fall back to the stream transport when UDP is blocked
+	if device.transport.useStream() {
+		transport, fd, err := device.dialStream(raddr)
+		if err != nil {
+			return -1, err
+		}
+		netc.transport = transport
+		logger.Wlog.SaveInfoLog("创建新的" + transport.Name() + "连接:" + transport.LocalAddr().String())
+
+		signalSend(device.signal.newUDPConn)
+		return fd, nil
 	}
 
 	// open new connection
@@ -47,7 +58,7 @@ func createUDPConn(device *Device, raddr *net.UDPAddr) (int, error) {
 	}
 
 	setMark(conn, uint32(fwmarkIoctl))
-	netc.conn = conn
+	netc.transport = newUDPTransport(conn)
 
 	logger.Wlog.SaveInfoLog("创建新的udp连接:" + conn.LocalAddr().String())
 
@@ -82,7 +93,7 @@ func setMark(conn *net.UDPConn, mark uint32) error {
 		return err
 	}
 	err = fd.Control(func(fd uintptr) {
-		err = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, fwmarkIoctl, int(mark))
+		err = setMarkFd(fd, mark)
 	})
 	if err != nil {
 		return err
@@ -91,9 +102,26 @@ func setMark(conn *net.UDPConn, mark uint32) error {
 	return nil
 }
 
+func setMarkFd(fd uintptr, mark uint32) error {
+	if fwmarkIoctl == 0 {
+		return nil
+	}
+	return setsockoptInt(fd, fwmarkIoctl, int(mark))
+}
+
 func closeUDPConn(device *Device) {
 	device.net.mutex.Lock()
-	device.net.conn.Close()
+	if device.net.transport != nil {
+		device.net.transport.Close()
+	}
+	if device.net.listener != nil {
+		device.net.listener.Close()
+		device.net.listener = nil
+	}
+	if device.net.webSocket != nil {
+		device.net.webSocket.Close()
+		device.net.webSocket = nil
+	}
 	device.net.mutex.Unlock()
 	signalSend(device.signal.newUDPConn)
 }
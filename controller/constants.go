@@ -35,8 +35,10 @@ const (
 	MinMessageSize     = MessageKeepaliveSize                  // minimum size of transport message (keepalive)
 	MaxMessageSize     = MaxSegmentSize                        // maximum size of transport message
 	MaxContentSize     = MaxSegmentSize - MessageTransportSize // maximum size of transport message content
+	UDPBatchSize       = 32                                    // datagrams per batched receive or send
 )
 
 const (
-	UnderLoadQueueSize = QueueHandshakeSize / 4
+	UnderLoadQueueDivisor = 4  // under load from a quarter of the handshake queue
+	MaxWorkers            = 64 // upper bound of encryption and decryption workers
 )
@@ -1,18 +1,25 @@
 package controller
 
 import (
+	"errors"
 	"net"
+	"net/http"
+	"runtime"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"bt/logger"
-	
-	"unsafe"
 )
 
 type Device struct {
+	// fields accessed with 64-bit atomics come first, only the start of an
+	// allocated struct is 8-byte aligned on 32-bit platforms (arm, 386)
+	counters   Counters     // only 64-bit fields, keeps what follows aligned
+	pmtu       PathMTU      // int64 first, 16 bytes
+	memory     MemoryBudget // int64 first, size a multiple of 8
+	killSwitch KillSwitch   // int64 first
+
 	tun struct {
 		device *NativeTun
 		mtu    int32
@@ -21,8 +28,10 @@ type Device struct {
 		messageBuffers sync.Pool
 	}
 	net struct {
-		mutex sync.RWMutex
-		conn  *net.UDPConn // UDP "connection"
+		mutex     sync.RWMutex
+		transport Transport       // UDP "connection" or stream fallback
+		listener  *StreamListener // server side stream listener
+		webSocket *StreamListener // server side WebSocket listener
 	}
 	// netFd int
 	mutex        sync.RWMutex
@@ -43,6 +52,22 @@ type Device struct {
 	ratelimiter    Ratelimiter
 	peers          *Peer
 	mac            CookieChecker
+	quality        Quality
+	capture        PacketCapture
+	mssClamp       AtomicBool
+	layout         int32 // handshake layout, accessed atomically
+	bypass         Bypass
+	domainRoutes   DomainRoutes
+	obfuscation    Obfuscation
+	transport      TransportConfig
+	workers        int32 // encryption and decryption workers, 0 for one per CPU
+	icmp           ICMPFeedback
+	firewall       Firewall
+	flows          FlowTracker
+	metrics        struct {
+		mutex  sync.Mutex
+		server *http.Server
+	}
 }
 
 /* Warning:
@@ -60,7 +85,7 @@ func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
 
 	now := time.Now()
-	underLoad := len(device.queue.handshake) >= UnderLoadQueueSize
+	underLoad := len(device.queue.handshake) >= cap(device.queue.handshake)/UnderLoadQueueDivisor
 	if underLoad {
 		device.underLoadUntil.Store(now.Add(time.Second))
 		return true
@@ -100,10 +125,12 @@ func (device *Device) SetPublicKey(sk NoisePublicKey) error {
 }
 
 func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
+	device.memory.taken()
 	return device.pool.messageBuffers.Get().(*[MaxMessageSize]byte)
 }
 
 func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
+	device.memory.returned()
 	device.pool.messageBuffers.Put(msg)
 }
 
@@ -115,10 +142,15 @@ func NewDevice(tun *NativeTun) *Device {
 
 	device.peers = &Peer{}
 	device.tun.device = tun
+	mtu, _ := tun.MTU()
+	device.tun.mtu = int32(mtu)
+	device.pmtu.configured = int32(mtu)
 	device.indices.Init()
 	device.ratelimiter.Init()
 	device.routingTable.Reset()
 	device.underLoadUntil.Store(time.Time{})
+	device.memory.init()
+	device.SetMemoryBudget(0)
 
 	// setup pools
 	device.pool.messageBuffers = sync.Pool{
@@ -145,6 +177,7 @@ func (d *Device) StartConnection() {
 	IntervalStartTime = time.Now().Unix()
 	go checkIntervalTime(d)
 	go monitorWifi(d)
+	d.resizeQueues()
 	go d.peers.RoutineNonce()
 	go d.peers.RoutineTimerHandler()
 	go d.peers.RoutineHandshakeInitiator()
@@ -154,16 +187,81 @@ func (d *Device) StartConnection() {
 	time.Sleep(time.Second / 2)
 	signalSend(d.peers.signal.handshakeReset)
 	//go taskSendFlow(d)
-	go taskGC(d)
 
 	// start workers
-	go d.RoutineEncryption()
-	go d.RoutineDecryption()
+	for i := 0; i < d.Workers(); i++ {
+		go d.RoutineEncryption()
+		go d.RoutineDecryption()
+	}
 	go d.RoutineHandshake()
 
 	go d.ratelimiter.RoutineGarbageCollector(d.signal.stop)
 	go d.RoutineReadFromTUN()
 	go d.RoutineReceiveIncomming()
+	go d.RoutineQualityReporter()
+	go d.RoutinePathMTUDiscovery()
+	go d.RoutineBypassReload()
+	go d.RoutineDomainRoutes()
+}
+
+func (device *Device) Routes() []net.IPNet {
+	return device.routingTable.Routes(device.domainRoutes.Prefixes(), device.bypass.Prefixes())
+}
+
+func (device *Device) LoadBypass(path string) error {
+	return device.bypass.Load(path)
+}
+
+func (device *Device) ReloadBypass() error {
+	return device.bypass.Reload()
+}
+
+func (device *Device) LookupBypass(ip net.IP) bool {
+	return device.bypass.Contains(ip)
+}
+
+/* Sets the number of encryption and decryption workers,
+ * takes effect when the connection is started
+ */
+func (device *Device) SetWorkers(workers int) error {
+	if workers < 0 || workers > MaxWorkers {
+		return errors.New("invalid number of workers")
+	}
+	atomic.StoreInt32(&device.workers, int32(workers))
+	return nil
+}
+
+func (device *Device) Workers() int {
+	workers := int(atomic.LoadInt32(&device.workers))
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	return workers
+}
+
+/* Sets the budget in MiB, 0 for the default of the platform:
+ * the iOS network extension is killed above its memory limit,
+ * the buffers are always bounded there, other platforms have no budget
+ */
+func (device *Device) SetMemoryBudget(megabytes int) error {
+	if megabytes == 0 && IsiOS {
+		megabytes = MemoryBudgetiOS
+	}
+	return device.memory.SetBudget(megabytes)
+}
+
+/* Sets the depth of a queue (QueueOutbound, QueueInbound or QueueHandshake),
+ * takes effect when the connection is started
+ */
+func (device *Device) SetQueueSize(queue int, size int) error {
+	return device.memory.SetQueueSize(queue, size)
+}
+
+/* Replaces the outer packet obfuscation with a custom transform,
+ * nil disables obfuscation
+ */
+func (device *Device) SetObfuscator(obfuscator Obfuscator) {
+	device.obfuscation.Set(obfuscator)
 }
 
 func (device *Device) LookupPeer() *Peer {
@@ -179,8 +277,10 @@ func (device *Device) RemovePeer() {
 }
 
 func (device *Device) Close() {
-	
-	syscall.Close(syscall.Handle(uintptr(unsafe.Pointer(&device.tun.device.fd))))
+	device.StopMetrics()
+	device.StopCapture()
+
+	device.tun.device.closeFd()
 	device.RemovePeer()
 	close(device.signal.stop)
 	closeUDPConn(device)
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Returns a device with pools, queues and signals,
+ * without TUN, peer or network; close device.signal.stop when done
+ */
+func newTestDevice(mtu int) *Device {
+	device := new(Device)
+	device.tun.mtu = int32(mtu)
+	device.memory.init()
+	device.routingTable.Reset()
+	device.underLoadUntil.Store(time.Time{})
+	device.pool.messageBuffers = sync.Pool{
+		New: func() interface{} {
+			return new([MaxMessageSize]byte)
+		},
+	}
+	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
+	device.queue.encryption = make(chan *QueueOutboundElement, QueueOutboundSize)
+	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.signal.stop = make(chan struct{})
+	device.signal.newUDPConn = make(chan struct{}, 1)
+	return device
+}
+
+/* Returns a key pair sending and receiving with the same random key
+ */
+func newTestKeyPair() *KeyPair {
+	var key [chacha20poly1305.KeySize]byte
+	rand.Read(key[:])
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		panic(err)
+	}
+	return &KeyPair{
+		send:        aead,
+		receive:     aead,
+		created:     time.Now(),
+		localIndex:  1,
+		remoteIndex: 1,
+	}
+}
+
+/* The fields accessed with 64-bit atomics must be 8-byte aligned
+ * on 32-bit platforms too, run with GOARCH=386 to check
+ */
+func TestAtomicAlignment(t *testing.T) {
+	var device Device
+	var rule FirewallRule
+	var keyPair KeyPair
+	for _, field := range []struct {
+		name   string
+		offset uintptr
+	}{
+		{"Device.counters", unsafe.Offsetof(device.counters)},
+		{"Device.pmtu.lastReceived", unsafe.Offsetof(device.pmtu) + unsafe.Offsetof(device.pmtu.lastReceived)},
+		{"Device.memory.limit", unsafe.Offsetof(device.memory) + unsafe.Offsetof(device.memory.limit)},
+		{"Device.memory.inFlight", unsafe.Offsetof(device.memory) + unsafe.Offsetof(device.memory.inFlight)},
+		{"Device.killSwitch.maxAge", unsafe.Offsetof(device.killSwitch) + unsafe.Offsetof(device.killSwitch.maxAge)},
+		{"Device.killSwitch.lastReport", unsafe.Offsetof(device.killSwitch) + unsafe.Offsetof(device.killSwitch.lastReport)},
+		{"FirewallRule.hits", unsafe.Offsetof(rule.hits)},
+		{"KeyPair.sendNonce", unsafe.Offsetof(keyPair.sendNonce)},
+	} {
+		if field.offset%8 != 0 {
+			t.Errorf("%s at offset %d", field.name, field.offset)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package controller
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"bt/logger"
+)
+
+/* Domain based split routing
+ *
+ * DNS responses crossing the TUN device are snooped:
+ * when the question matches a configured domain pattern,
+ * the A/AAAA answers are inserted into the routing table
+ * and removed again once their TTL expired.
+ *
+ * A pattern "example.com" matches the domain and all its subdomains,
+ * "*.example.com" matches the subdomains only.
+ *
+ * The system only hands the TUN the traffic of the routes installed by the app,
+ * so every change of the domain routes is reported through RoutesChan
+ * with the complete list of routes (as GetRoutes), for the app to reconfigure.
+ */
+
+const (
+	UDPProtocol        = 17
+	UDPHeaderLen       = 8
+	DNSPort            = 53
+	DNSHeaderLen       = 12
+	DNSTypeA           = 1
+	DNSTypeAAAA        = 28
+	DNSClassIN         = 1
+	DNSRouteMinTTL     = time.Minute
+	DNSRouteMaxTTL     = time.Hour * 24
+	DNSRouteMaxEntries = 4096
+	DNSRouteGCInterval = time.Second * 10
+)
+
+type dnsRoute struct {
+	ip      net.IP
+	expires time.Time
+}
+
+type DomainRoutes struct {
+	enabled  AtomicBool
+	mutex    sync.Mutex
+	patterns []string
+	routes   map[string]dnsRoute
+}
+
+func (dr *DomainRoutes) AddPattern(pattern string) {
+	pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+	if pattern == "" {
+		return
+	}
+
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.patterns = append(dr.patterns, pattern)
+	dr.enabled.Set(true)
+}
+
+/* Caller must hold the mutex
+ */
+func (dr *DomainRoutes) matchLocked(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, pattern := range dr.patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(name, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if name == pattern || strings.HasSuffix(name, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Returns the UDP payload of a DNS response, or nil
+ */
+func dnsResponsePayload(packet []byte) []byte {
+	var udp []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[IPv4offsetProtocol] != UDPProtocol {
+			return nil
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < ihl+UDPHeaderLen {
+			return nil
+		}
+		udp = packet[ihl:]
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen+UDPHeaderLen || packet[IPv6offsetNextHeader] != UDPProtocol {
+			return nil
+		}
+		udp = packet[ipv6.HeaderLen:]
+	default:
+		return nil
+	}
+	if binary.BigEndian.Uint16(udp[0:2]) != DNSPort {
+		return nil
+	}
+	return udp[UDPHeaderLen:]
+}
+
+/* Reads a (possibly compressed) name at offset,
+ * returns the name and the offset following it
+ */
+func dnsReadName(msg []byte, offset int) (string, int, bool) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if offset >= len(msg) {
+			return "", 0, false
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, true
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, false
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, false
+}
+
+/* Parses a DNS response and returns the A/AAAA answers with their TTL,
+ * if the first question matches one of the patterns
+ */
+func (dr *DomainRoutes) parseResponse(msg []byte) []dnsRoute {
+	if len(msg) < DNSHeaderLen || msg[2]&0x80 == 0 {
+		return nil
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	if qdcount == 0 || ancount == 0 {
+		return nil
+	}
+
+	offset := DNSHeaderLen
+	name, offset, ok := dnsReadName(msg, offset)
+	if !ok {
+		return nil
+	}
+
+	dr.mutex.Lock()
+	match := dr.matchLocked(name)
+	dr.mutex.Unlock()
+	if !match {
+		return nil
+	}
+
+	// skip questions
+
+	offset += 4
+	for i := 1; i < qdcount; i++ {
+		_, offset, ok = dnsReadName(msg, offset)
+		if !ok {
+			return nil
+		}
+		offset += 4
+	}
+
+	// collect address records (including those following CNAMEs)
+
+	var answers []dnsRoute
+	now := time.Now()
+	for i := 0; i < ancount; i++ {
+		_, offset, ok = dnsReadName(msg, offset)
+		if !ok || offset+10 > len(msg) {
+			return answers
+		}
+		rrtype := binary.BigEndian.Uint16(msg[offset:])
+		class := binary.BigEndian.Uint16(msg[offset+2:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[offset+4:])) * time.Second
+		rdlength := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+rdlength > len(msg) {
+			return answers
+		}
+		rdata := msg[offset : offset+rdlength]
+		offset += rdlength
+
+		if class != DNSClassIN {
+			continue
+		}
+		if ttl < DNSRouteMinTTL {
+			ttl = DNSRouteMinTTL
+		}
+		if ttl > DNSRouteMaxTTL {
+			ttl = DNSRouteMaxTTL
+		}
+		switch {
+		case rrtype == DNSTypeA && rdlength == net.IPv4len:
+			answers = append(answers, dnsRoute{ip: net.IP(append([]byte{}, rdata...)), expires: now.Add(ttl)})
+		case rrtype == DNSTypeAAAA && rdlength == net.IPv6len:
+			answers = append(answers, dnsRoute{ip: net.IP(append([]byte{}, rdata...)), expires: now.Add(ttl)})
+		}
+	}
+	return answers
+}
+
+/* Inspects a packet on the TUN paths and routes
+ * the addresses resolved for matching domains through the tunnel
+ */
+func (device *Device) snoopDNS(packet []byte) {
+	dr := &device.domainRoutes
+	if len(packet) == 0 || !dr.enabled.Get() {
+		return
+	}
+	msg := dnsResponsePayload(packet)
+	if msg == nil {
+		return
+	}
+	answers := dr.parseResponse(msg)
+	if len(answers) == 0 {
+		return
+	}
+
+	peer := device.LookupPeer()
+	if peer == nil {
+		return
+	}
+
+	added := false
+	dr.mutex.Lock()
+	defer func() {
+		dr.mutex.Unlock()
+		if added {
+			device.notifyRoutes()
+		}
+	}()
+
+	if dr.routes == nil {
+		dr.routes = make(map[string]dnsRoute)
+	}
+	for _, answer := range answers {
+		key := string(answer.ip)
+		if old, ok := dr.routes[key]; ok {
+			if answer.expires.After(old.expires) {
+				dr.routes[key] = answer
+			}
+			continue
+		}
+		if len(dr.routes) >= DNSRouteMaxEntries {
+			continue
+		}
+		dr.routes[key] = answer
+		device.routingTable.Insert(answer.ip, uint(len(answer.ip)*8), peer, RouteSourceDNS)
+		added = true
+		logger.Wlog.SaveDebugLog("domain route added:" + answer.ip.String())
+	}
+}
+
+/* Removes the expired domain routes
+ */
+func (device *Device) RoutineDomainRoutes() {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Wlog.SaveErrLog(fmt.Sprintln("recover RoutineDomainRoutes err:", err))
+		}
+	}()
+
+	t := time.NewTicker(DNSRouteGCInterval)
+	defer t.Stop()
+
+	dr := &device.domainRoutes
+	for {
+		select {
+		case <-device.signal.stop:
+			return
+		case <-t.C:
+			now := time.Now()
+			removed := false
+			dr.mutex.Lock()
+			for key, route := range dr.routes {
+				if now.After(route.expires) {
+					delete(dr.routes, key)
+					device.routingTable.Remove(route.ip, uint(len(route.ip)*8), RouteSourceDNS)
+					removed = true
+				}
+			}
+			dr.mutex.Unlock()
+			if removed {
+				device.notifyRoutes()
+			}
+		}
+	}
+}
+
+/* Host routes of the resolved addresses
+ */
+func (dr *DomainRoutes) Prefixes() []net.IPNet {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+
+	prefixes := make([]net.IPNet, 0, len(dr.routes))
+	for _, route := range dr.routes {
+		bits := len(route.ip) * 8
+		prefixes = append(prefixes, net.IPNet{IP: route.ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return prefixes
+}
+
+/* Reports the current routes to the app, a pending report is replaced
+ */
+func (device *Device) notifyRoutes() {
+	routes := device.Routes()
+	list := make([]string, 0, len(routes))
+	for _, v := range routes {
+		list = append(list, v.String())
+	}
+	s := strings.Join(list, ",")
+
+	for {
+		select {
+		case RoutesChan <- s:
+			return
+		default:
+		}
+		select {
+		case <-RoutesChan:
+		default:
+		}
+	}
+}
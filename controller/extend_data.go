@@ -1,9 +1,14 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"net"
+
+	"bt/logger"
 )
 
 const (
@@ -11,8 +16,15 @@ const (
 	signSize      = 16
 	allowIpSize   = 4
 	netmaskSize   = 4
+	allowIp6Size  = 16
+	prefix6Size   = 1
 )
 
+/* Shortest IPv6 prefix routed to a peer, longer requests are
+ * routed as requested, shorter ones are rejected
+ */
+const MinInnerPrefix6 = 64
+
 type timestampData [timestampSize]byte
 type signData [signSize]byte
 
@@ -44,3 +56,170 @@ func newNetmaskData() [netmaskSize]byte {
 	binary.BigEndian.PutUint32(data[:], Netmask)
 	return data
 }
+
+func newAllowIp6Data() [allowIp6Size]byte {
+	var data [allowIp6Size]byte
+	ip := net.ParseIP(AllowIp6)
+	if ip == nil || ip.To4() != nil {
+		return data
+	}
+
+	copy(data[:], ip.To16())
+	return data
+}
+
+func newPrefix6Data() [prefix6Size]byte {
+	var data [prefix6Size]byte
+	if net.ParseIP(AllowIp6) == nil || Prefix6 > 128 {
+		return data
+	}
+	data[0] = Prefix6
+	return data
+}
+
+/* Custom fields of the initiation
+ */
+func newInitiationExtensions() ExtensionBlock {
+	block := ExtensionBlock{Version: ExtensionVersion}
+
+	ts := newTimestampData()
+	sign := newSignData()
+	allowIp := newAllowIpData()
+	netmask := newNetmaskData()
+	block.Add(ExtensionTypeTs, ts[:])
+	block.Add(ExtensionTypeSign, sign[:])
+	block.Add(ExtensionTypeAllowIp, allowIp[:])
+	block.Add(ExtensionTypeNetmask, netmask[:])
+
+	if allowIp6 := newAllowIp6Data(); !isZero(allowIp6[:]) {
+		prefix6 := newPrefix6Data()
+		block.Add(ExtensionTypeAllowIp6, append(allowIp6[:], prefix6[:]...))
+	}
+	return block
+}
+
+/* Fixed layout of the custom fields used before the extension area,
+ * the IPv6 fields are only present when an IPv6 address is requested
+ */
+type legacyExtensions struct {
+	Ts      timestampData
+	Sign    signData
+	AllowIp [allowIpSize]byte
+	Netmask [netmaskSize]byte
+}
+
+type legacyExtensionsIPv6 struct {
+	legacyExtensions
+	AllowIp6 [allowIp6Size]byte
+	Prefix6  [prefix6Size]byte
+}
+
+const (
+	legacyExtensionsSize     = timestampSize + signSize + allowIpSize + netmaskSize
+	legacyExtensionsIPv6Size = legacyExtensionsSize + allowIp6Size + prefix6Size
+)
+
+func writeLegacyExtensions(writer io.Writer, block *ExtensionBlock) error {
+	var fields legacyExtensionsIPv6
+	copy(fields.Ts[:], block.Get(ExtensionTypeTs))
+	copy(fields.Sign[:], block.Get(ExtensionTypeSign))
+	copy(fields.AllowIp[:], block.Get(ExtensionTypeAllowIp))
+	copy(fields.Netmask[:], block.Get(ExtensionTypeNetmask))
+
+	allowIp6 := block.Get(ExtensionTypeAllowIp6)
+	if len(allowIp6) != allowIp6Size+prefix6Size {
+		return binary.Write(writer, binary.LittleEndian, fields.legacyExtensions)
+	}
+	copy(fields.AllowIp6[:], allowIp6)
+	fields.Prefix6[0] = allowIp6[allowIp6Size]
+	return binary.Write(writer, binary.LittleEndian, fields)
+}
+
+func readLegacyExtensions(data []byte) (ExtensionBlock, error) {
+	var block ExtensionBlock
+	var fields legacyExtensionsIPv6
+
+	reader := bytes.NewReader(data)
+	switch len(data) {
+	case legacyExtensionsSize:
+		if err := binary.Read(reader, binary.LittleEndian, &fields.legacyExtensions); err != nil {
+			return block, err
+		}
+	case legacyExtensionsIPv6Size:
+		if err := binary.Read(reader, binary.LittleEndian, &fields); err != nil {
+			return block, err
+		}
+		block.Add(ExtensionTypeAllowIp6, append(fields.AllowIp6[:], fields.Prefix6[:]...))
+	default:
+		return block, errors.New("invalid initiation size")
+	}
+
+	block.Add(ExtensionTypeTs, fields.Ts[:])
+	block.Add(ExtensionTypeSign, fields.Sign[:])
+	block.Add(ExtensionTypeAllowIp, fields.AllowIp[:])
+	block.Add(ExtensionTypeNetmask, fields.Netmask[:])
+	return block, nil
+}
+
+/* Returns the inner addresses requested by the initiator,
+ * nil for an address that was not requested or is not acceptable
+ */
+func (msg *MessageInitiation) innerAddresses() (*net.IPNet, *net.IPNet) {
+	var addr4, addr6 *net.IPNet
+
+	if data := msg.Extensions.Get(ExtensionTypeAllowIp); len(data) == allowIpSize {
+		ip := net.IP(append([]byte{}, data...))
+		if validInnerAddress(ip) {
+			addr4 = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		}
+	}
+
+	if data := msg.Extensions.Get(ExtensionTypeAllowIp6); len(data) == allowIp6Size+prefix6Size {
+		ip := net.IP(append([]byte{}, data[:allowIp6Size]...))
+		prefix := int(data[allowIp6Size])
+		if ip.To4() == nil && validInnerAddress(ip) && prefix >= MinInnerPrefix6 && prefix <= 128 {
+			mask := net.CIDRMask(prefix, 128)
+			addr6 = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		}
+	}
+
+	return addr4, addr6
+}
+
+func validInnerAddress(ip net.IP) bool {
+	return !ip.IsUnspecified() &&
+		!ip.IsLoopback() &&
+		!ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.Equal(net.IPv4bcast)
+}
+
+/* Replaces the routes of the inner addresses previously requested by peer
+ * with those of the accepted initiation
+ */
+func (device *Device) assignInnerAddresses(peer *Peer, msg *MessageInitiation) {
+	addr4, addr6 := msg.innerAddresses()
+
+	var addresses []net.IPNet
+	if addr4 != nil {
+		addresses = append(addresses, *addr4)
+	}
+	if addr6 != nil {
+		addresses = append(addresses, *addr6)
+	} else if msg.Extensions.Get(ExtensionTypeAllowIp6) != nil {
+		logger.Wlog.SaveInfoLog("Rejected requested inner IPv6 address from: " + peer.String())
+	}
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	for _, old := range peer.innerAddresses {
+		ones, _ := old.Mask.Size()
+		device.routingTable.Remove(old.IP, uint(ones), RouteSourcePeer)
+	}
+	for _, addr := range addresses {
+		ones, _ := addr.Mask.Size()
+		device.routingTable.Insert(addr.IP, uint(ones), peer, RouteSourcePeer)
+	}
+	peer.innerAddresses = addresses
+}
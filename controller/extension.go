@@ -0,0 +1,486 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+
+	"bt/logger"
+)
+
+/* Handshake extension area
+ *
+ * The custom fields of the initiation are carried in a versioned,
+ * length-prefixed block placed between the noise fields and the MACs:
+ *
+ *   version (1) | length (2, little endian) | TLVs
+ *   TLV: type (1) | length (1) | value
+ *
+ * Unknown types are skipped, so new fields can be added without
+ * breaking deployed peers. The responder answers with the negotiated
+ * version and the extension types it accepted, the block is mixed into
+ * the handshake hash before the empty payload is sealed, so it cannot be
+ * altered on-path.
+ *
+ * In the initiation the block is sealed with a key derived from the chain key
+ * following the encrypted timestamp, the ciphertext is mixed into the handshake hash.
+ * Deployed gateways only accept the legacy layout, which carries the fields
+ * in the clear. By default (handshake_layout=auto) a peer which never answered
+ * an extended initiation gets the legacy layout after repeated unanswered ones,
+ * and the extended layout is retried periodically. Once a peer answered an
+ * extended initiation it never gets the legacy layout again, so dropping
+ * initiations on-path cannot make the client reveal the fields to an upgraded
+ * gateway. handshake_layout=extended never falls back.
+ */
+
+const (
+	ExtensionVersion          = 1
+	ExtensionHeaderSize       = 3
+	ExtensionMaxSize          = 256 // including the header
+	ExtensionFallbackAttempts = 2   // unanswered extended initiations before falling back
+	ExtensionRetryInterval    = time.Minute * 10
+)
+
+const (
+	HandshakeLayoutAuto     = "auto"
+	HandshakeLayoutExtended = "extended"
+	HandshakeLayoutLegacy   = "legacy"
+)
+
+const (
+	handshakeLayoutAuto = iota
+	handshakeLayoutExtended
+	handshakeLayoutLegacy
+)
+
+const (
+	ExtensionTypeTs       = 1 // expiry time, 4 bytes big endian
+	ExtensionTypeSign     = 2 // signature, 16 bytes
+	ExtensionTypeAllowIp  = 3 // requested IPv4 address, 4 bytes
+	ExtensionTypeNetmask  = 4 // 4 bytes big endian
+	ExtensionTypeAllowIp6 = 5 // requested IPv6 address and prefix length, 17 bytes
+	ExtensionTypeAccepted = 6 // response only, list of accepted types
+)
+
+const (
+	MessageInitiationExtendedType = 5
+	MessageResponseExtendedType   = 6
+)
+
+const (
+	MessageInitiationHeaderSize    = 116 // noise fields of the initiation
+	MessageResponseHeaderSize      = 60  // noise fields of the response
+	MessageInitiationMinSize       = MessageInitiationHeaderSize + ExtensionHeaderSize + poly1305.TagSize + blake2s.Size128*2
+	MessageInitiationMaxSize       = MessageInitiationHeaderSize + ExtensionMaxSize + poly1305.TagSize + blake2s.Size128*2
+	MessageResponseExtendedMinSize = MessageResponseHeaderSize + ExtensionHeaderSize + blake2s.Size128*2
+	MessageResponseExtendedMaxSize = MessageResponseHeaderSize + ExtensionMaxSize + blake2s.Size128*2
+)
+
+type Extension struct {
+	Type  uint8
+	Value []byte
+}
+
+type ExtensionBlock struct {
+	Version    uint8 // 0 for fields decoded from the legacy layout
+	Extensions []Extension
+}
+
+func (block *ExtensionBlock) Add(t uint8, value []byte) {
+	block.Extensions = append(block.Extensions, Extension{Type: t, Value: value})
+}
+
+/* Returns the value of the first extension of type t, or nil
+ */
+func (block *ExtensionBlock) Get(t uint8) []byte {
+	for _, ext := range block.Extensions {
+		if ext.Type == t {
+			return ext.Value
+		}
+	}
+	return nil
+}
+
+func (block *ExtensionBlock) Marshal() ([]byte, error) {
+	data := make([]byte, ExtensionHeaderSize, ExtensionMaxSize)
+	data[0] = block.Version
+	for _, ext := range block.Extensions {
+		if len(ext.Value) > 255 {
+			return nil, errors.New("extension value too long")
+		}
+		data = append(data, ext.Type, uint8(len(ext.Value)))
+		data = append(data, ext.Value...)
+	}
+	if len(data) > ExtensionMaxSize {
+		return nil, errors.New("extension area too long")
+	}
+	binary.LittleEndian.PutUint16(data[1:], uint16(len(data)-ExtensionHeaderSize))
+	return data, nil
+}
+
+func parseExtensionBlock(data []byte) (ExtensionBlock, error) {
+	var block ExtensionBlock
+	if len(data) < ExtensionHeaderSize || len(data) > ExtensionMaxSize {
+		return block, errors.New("invalid extension area size")
+	}
+	block.Version = data[0]
+	if block.Version == 0 {
+		return block, errors.New("invalid extension version")
+	}
+	if int(binary.LittleEndian.Uint16(data[1:])) != len(data)-ExtensionHeaderSize {
+		return block, errors.New("invalid extension area length")
+	}
+
+	tlvs := data[ExtensionHeaderSize:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 2 || len(tlvs) < 2+int(tlvs[1]) {
+			return block, errors.New("truncated extension")
+		}
+		length := int(tlvs[1])
+		block.Add(tlvs[0], append([]byte{}, tlvs[2:2+length]...))
+		tlvs = tlvs[2+length:]
+	}
+	return block, nil
+}
+
+func supportedExtension(t uint8) bool {
+	return t >= ExtensionTypeTs && t <= ExtensionTypeAllowIp6
+}
+
+/* Header of the messages, the fields preceding the extension area
+ */
+type messageInitiationHeader struct {
+	Type      uint32
+	Sender    uint32
+	Ephemeral NoisePublicKey
+	Static    [NoisePublicKeySize + poly1305.TagSize]byte
+	Timestamp [TAI64NSize + poly1305.TagSize]byte
+}
+
+type messageResponseHeader struct {
+	Type      uint32
+	Sender    uint32
+	Receiver  uint32
+	Ephemeral NoisePublicKey
+	Empty     [poly1305.TagSize]byte
+}
+
+func (msg *MessageInitiation) marshal(writer io.Writer) error {
+	header := messageInitiationHeader{
+		Type:      msg.Type,
+		Sender:    msg.Sender,
+		Ephemeral: msg.Ephemeral,
+		Static:    msg.Static,
+		Timestamp: msg.Timestamp,
+	}
+	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case MessageInitiationExtendedType:
+		if _, err := writer.Write(msg.sealed); err != nil {
+			return err
+		}
+	default:
+		if err := writeLegacyExtensions(writer, &msg.Extensions); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, msg.MAC1); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.LittleEndian, msg.MAC2)
+}
+
+func (msg *MessageInitiation) unmarshal(packet []byte) error {
+	if len(packet) < MessageInitiationHeaderSize+blake2s.Size128*2 {
+		return errors.New("initiation too short")
+	}
+
+	var header messageInitiationHeader
+	reader := bytes.NewReader(packet[:MessageInitiationHeaderSize])
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	msg.Type = header.Type
+	msg.Sender = header.Sender
+	msg.Ephemeral = header.Ephemeral
+	msg.Static = header.Static
+	msg.Timestamp = header.Timestamp
+
+	smac2 := len(packet) - blake2s.Size128
+	smac1 := smac2 - blake2s.Size128
+	copy(msg.MAC1[:], packet[smac1:smac2])
+	copy(msg.MAC2[:], packet[smac2:])
+
+	// the extended block is opened when the initiation is consumed
+
+	var err error
+	area := packet[MessageInitiationHeaderSize:smac1]
+	switch msg.Type {
+	case MessageInitiationExtendedType:
+		msg.sealed = append([]byte{}, area...)
+	default:
+		msg.Extensions, err = readLegacyExtensions(area)
+	}
+	return err
+}
+
+var extensionLabel = []byte("bt handshake extensions")
+
+func extensionKey(chainKey *[blake2s.Size]byte) [chacha20poly1305.KeySize]byte {
+	var unused [blake2s.Size]byte
+	var key [chacha20poly1305.KeySize]byte
+	KDF2(&unused, &key, chainKey[:], extensionLabel)
+	return key
+}
+
+/* Seals the extension block of an initiation,
+ * the ciphertext is mixed into hash
+ */
+func sealExtensions(chainKey *[blake2s.Size]byte, hash *[blake2s.Size]byte, block *ExtensionBlock) ([]byte, error) {
+	data, err := block.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	key := extensionKey(chainKey)
+	aead, _ := chacha20poly1305.New(key[:])
+	sealed := aead.Seal(nil, ZeroNonce[:], data, hash[:])
+	setZero(key[:])
+
+	mixHash(hash, hash, sealed)
+	return sealed, nil
+}
+
+/* Opens the extension block of an initiation,
+ * the ciphertext is mixed into hash
+ */
+func openExtensions(chainKey *[blake2s.Size]byte, hash *[blake2s.Size]byte, sealed []byte) (ExtensionBlock, error) {
+	key := extensionKey(chainKey)
+	aead, _ := chacha20poly1305.New(key[:])
+	data, err := aead.Open(nil, ZeroNonce[:], sealed, hash[:])
+	setZero(key[:])
+	if err != nil {
+		return ExtensionBlock{}, err
+	}
+
+	block, err := parseExtensionBlock(data)
+	if err != nil {
+		return block, err
+	}
+	mixHash(hash, hash, sealed)
+	return block, nil
+}
+
+func (msg *MessageResponse) marshal(writer io.Writer) error {
+	header := messageResponseHeader{
+		Type:      msg.Type,
+		Sender:    msg.Sender,
+		Receiver:  msg.Receiver,
+		Ephemeral: msg.Ephemeral,
+		Empty:     msg.Empty,
+	}
+	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if msg.Type == MessageResponseExtendedType {
+		if _, err := writer.Write(msg.extensions); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, msg.MAC1); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.LittleEndian, msg.MAC2)
+}
+
+func (msg *MessageResponse) unmarshal(packet []byte) error {
+	if len(packet) < MessageResponseSize {
+		return errors.New("response too short")
+	}
+
+	var header messageResponseHeader
+	reader := bytes.NewReader(packet[:MessageResponseHeaderSize])
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	msg.Type = header.Type
+	msg.Sender = header.Sender
+	msg.Receiver = header.Receiver
+	msg.Ephemeral = header.Ephemeral
+	msg.Empty = header.Empty
+
+	smac2 := len(packet) - blake2s.Size128
+	smac1 := smac2 - blake2s.Size128
+	copy(msg.MAC1[:], packet[smac1:smac2])
+	copy(msg.MAC2[:], packet[smac2:])
+
+	area := packet[MessageResponseHeaderSize:smac1]
+	switch msg.Type {
+	case MessageResponseExtendedType:
+		var err error
+		msg.extensions = append([]byte{}, area...)
+		msg.Extensions, err = parseExtensionBlock(area)
+		return err
+	case MessageResponseType:
+		if len(area) != 0 {
+			return errors.New("invalid response size")
+		}
+	}
+	return nil
+}
+
+/* Extension negotiation state of a peer
+ */
+type ExtensionState struct {
+	mutex      sync.Mutex
+	negotiated bool
+	version    uint8
+	accepted   []uint8
+	supported  bool // answered an extended initiation once, never falls back
+	legacy     bool // fell back to the legacy layout
+	unanswered int
+	fallback   time.Time
+}
+
+/* Selects the layout of the initiations sent
+ */
+func (device *Device) SetHandshakeLayout(layout string) error {
+	switch layout {
+	case HandshakeLayoutAuto:
+		atomic.StoreInt32(&device.layout, handshakeLayoutAuto)
+	case HandshakeLayoutExtended:
+		atomic.StoreInt32(&device.layout, handshakeLayoutExtended)
+	case HandshakeLayoutLegacy:
+		atomic.StoreInt32(&device.layout, handshakeLayoutLegacy)
+		logger.Wlog.SaveInfoLog("Legacy handshake layout configured, the initiation fields are sent in the clear")
+	default:
+		return errors.New("invalid handshake layout: " + layout)
+	}
+	return nil
+}
+
+/* Returns true if the next initiation to peer uses the extended layout
+ */
+func (device *Device) extendedInitiation(peer *Peer) bool {
+	switch atomic.LoadInt32(&device.layout) {
+	case handshakeLayoutExtended:
+		return true
+	case handshakeLayoutLegacy:
+		return false
+	}
+	return !peer.extensions.Legacy()
+}
+
+/* Returns true if the peer fell back to the legacy layout,
+ * the extended layout is retried after ExtensionRetryInterval
+ */
+func (state *ExtensionState) Legacy() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.legacy && time.Now().Sub(state.fallback) > ExtensionRetryInterval {
+		state.legacy = false
+		state.unanswered = 0
+	}
+	return state.legacy
+}
+
+/* Forgets the unanswered initiations,
+ * e.g. when the path to the peer changed
+ */
+func (state *ExtensionState) Reset() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.legacy = false
+	state.unanswered = 0
+}
+
+/* Called when an initiation timed out, falls back to the legacy layout
+ * if the peer never answered an extended initiation
+ */
+func (state *ExtensionState) Unanswered() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.supported || state.legacy {
+		return
+	}
+	state.unanswered++
+	if state.unanswered >= ExtensionFallbackAttempts {
+		state.legacy = true
+		state.fallback = time.Now()
+		logger.Wlog.SaveInfoLog("No answer to extended initiations, falling back to the legacy handshake layout")
+	}
+}
+
+/* Responder: negotiates the extensions of an initiation
+ * and returns the block of the response
+ */
+func (state *ExtensionState) Negotiate(request *ExtensionBlock) ExtensionBlock {
+	version := request.Version
+	if version > ExtensionVersion {
+		version = ExtensionVersion
+	}
+
+	var accepted []uint8
+	for _, ext := range request.Extensions {
+		if supportedExtension(ext.Type) && bytes.IndexByte(accepted, ext.Type) < 0 {
+			accepted = append(accepted, ext.Type)
+		}
+	}
+
+	state.mutex.Lock()
+	state.negotiated = true
+	state.version = version
+	state.accepted = accepted
+	state.mutex.Unlock()
+
+	response := ExtensionBlock{Version: version}
+	response.Add(ExtensionTypeAccepted, accepted)
+	return response
+}
+
+/* Initiator: records the outcome of the negotiation
+ */
+func (state *ExtensionState) Negotiated(response *ExtensionBlock) {
+	version := response.Version
+	if version > ExtensionVersion {
+		version = ExtensionVersion
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if !state.negotiated || state.version != version {
+		logger.Wlog.SaveInfoLog("Negotiated handshake extension version:" + strconv.Itoa(int(version)))
+	}
+	state.negotiated = true
+	state.version = version
+	state.accepted = append(state.accepted[:0], response.Get(ExtensionTypeAccepted)...)
+	state.supported = true
+	state.legacy = false
+	state.unanswered = 0
+}
+
+/* Returns true if the peer accepted extensions of type t
+ */
+func (state *ExtensionState) Accepted(t uint8) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.negotiated && bytes.IndexByte(state.accepted, t) >= 0
+}
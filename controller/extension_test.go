@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeLayoutFallback(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+	peer := new(Peer)
+
+	for i := 0; i < ExtensionFallbackAttempts; i++ {
+		if !device.extendedInitiation(peer) {
+			t.Fatalf("legacy layout after %d unanswered initiations", i)
+		}
+		peer.extensions.Unanswered()
+	}
+	if device.extendedInitiation(peer) {
+		t.Fatal("no fallback to the legacy layout")
+	}
+
+	peer.extensions.fallback = time.Now().Add(-ExtensionRetryInterval - time.Second)
+	if !device.extendedInitiation(peer) {
+		t.Fatal("extended layout not retried")
+	}
+
+	// a peer which answered once never falls back
+	peer.extensions.Negotiated(&ExtensionBlock{Version: ExtensionVersion})
+	for i := 0; i < ExtensionFallbackAttempts*2; i++ {
+		peer.extensions.Unanswered()
+	}
+	if !device.extendedInitiation(peer) {
+		t.Error("fell back after the peer answered an extended initiation")
+	}
+
+	peer = new(Peer)
+	device.SetHandshakeLayout(HandshakeLayoutExtended)
+	for i := 0; i < ExtensionFallbackAttempts; i++ {
+		peer.extensions.Unanswered()
+	}
+	if !device.extendedInitiation(peer) {
+		t.Error("fell back with the extended layout configured")
+	}
+	device.SetHandshakeLayout(HandshakeLayoutLegacy)
+	if device.extendedInitiation(new(Peer)) {
+		t.Error("extended initiation with the legacy layout configured")
+	}
+	if device.SetHandshakeLayout("v2") == nil {
+		t.Error("invalid layout accepted")
+	}
+}
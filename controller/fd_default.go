@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package controller
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func (tun *NativeTun) read(b []byte) (int, error) {
+	return unix.Read(tun.fd, b)
+}
+
+func (tun *NativeTun) write(b []byte) (int, error) {
+	return unix.Write(tun.fd, b)
+}
+
+func (tun *NativeTun) closeFd() {
+	unix.Close(tun.fd)
+}
+
+func setsockoptInt(fd uintptr, opt, value int) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, value)
+}
+
+/* Blocks reading the pipe the app closes to stop the tunnel
+ */
+func ReadPipe(fd *int32, p []byte) (int, error) {
+	return unix.Read(int(*fd), p)
+}
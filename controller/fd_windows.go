@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func (tun *NativeTun) read(b []byte) (int, error) {
+	return windows.Read(windows.Handle(uintptr(unsafe.Pointer(&tun.fd))), b)
+}
+
+func (tun *NativeTun) write(b []byte) (int, error) {
+	return windows.Write(windows.Handle(uintptr(unsafe.Pointer(&tun.fd))), b)
+}
+
+func (tun *NativeTun) closeFd() {
+	syscall.Close(syscall.Handle(uintptr(unsafe.Pointer(&tun.fd))))
+}
+
+func setsockoptInt(fd uintptr, opt, value int) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, opt, value)
+}
+
+/* Blocks reading the pipe the app closes to stop the tunnel
+ */
+func ReadPipe(fd *int32, p []byte) (int, error) {
+	return syscall.Read(syscall.Handle(uintptr(unsafe.Pointer(fd))), p)
+}
@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Inner packet firewall
+ *
+ * Rules are evaluated in order on the packets read from the TUN (out)
+ * and on the decrypted packets before they are written to the TUN (in),
+ * the first matching rule decides, packets matching no rule are allowed.
+ * A rule is written as
+ *
+ *   allow|deny in|out|any any|tcp|udp|icmp|<number> <cidr> [port[-port]]
+ *
+ * The CIDR matches the remote address (destination of outbound packets,
+ * source of inbound packets), the port range the destination port,
+ * so that "deny in tcp 0.0.0.0/0 22" rejects connections to a local service.
+ */
+
+const (
+	FirewallIn = iota
+	FirewallOut
+)
+
+const (
+	firewallAny     = -1
+	MaxFirewallRule = 256
+)
+
+type FirewallRule struct {
+	hits      uint64 // first for 64-bit alignment of the atomic counter
+	text      string
+	allow     bool
+	direction int // FirewallIn, FirewallOut or firewallAny
+	protocol  int // IP protocol number or firewallAny
+	network   *net.IPNet
+	portMin   uint16
+	portMax   uint16
+}
+
+type FirewallRuleStats struct {
+	Rule string `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+type Firewall struct {
+	mutex sync.RWMutex
+	rules []*FirewallRule
+}
+
+func ParseFirewallRule(text string) (*FirewallRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 4 && len(fields) != 5 {
+		return nil, errors.New("invalid firewall rule: " + text)
+	}
+	rule := &FirewallRule{
+		text:    strings.Join(fields, " "),
+		portMax: 0xffff,
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return nil, errors.New("invalid firewall action: " + fields[0])
+	}
+
+	switch fields[1] {
+	case "in":
+		rule.direction = FirewallIn
+	case "out":
+		rule.direction = FirewallOut
+	case "any":
+		rule.direction = firewallAny
+	default:
+		return nil, errors.New("invalid firewall direction: " + fields[1])
+	}
+
+	switch fields[2] {
+	case "any":
+		rule.protocol = firewallAny
+	case "tcp":
+		rule.protocol = TCPProtocol
+	case "udp":
+		rule.protocol = UDPProtocol
+	case "icmp":
+		rule.protocol = ICMPProtocol // also matches ICMPv6
+	default:
+		protocol, err := strconv.ParseUint(fields[2], 10, 8)
+		if err != nil {
+			return nil, errors.New("invalid firewall protocol: " + fields[2])
+		}
+		rule.protocol = int(protocol)
+	}
+
+	_, network, err := net.ParseCIDR(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	rule.network = network
+
+	if len(fields) == 5 {
+		if rule.protocol != TCPProtocol && rule.protocol != UDPProtocol {
+			return nil, errors.New("port range requires tcp or udp: " + text)
+		}
+		ports := strings.SplitN(fields[4], "-", 2)
+		min, err := strconv.ParseUint(ports[0], 10, 16)
+		if err != nil {
+			return nil, errors.New("invalid firewall port: " + fields[4])
+		}
+		max := min
+		if len(ports) == 2 {
+			max, err = strconv.ParseUint(ports[1], 10, 16)
+			if err != nil || max < min {
+				return nil, errors.New("invalid firewall port range: " + fields[4])
+			}
+		}
+		rule.portMin = uint16(min)
+		rule.portMax = uint16(max)
+	}
+	return rule, nil
+}
+
+func (rule *FirewallRule) String() string {
+	return rule.text
+}
+
+func (rule *FirewallRule) match(direction, protocol int, remote net.IP, port int) bool {
+	if rule.direction != firewallAny && rule.direction != direction {
+		return false
+	}
+	if rule.protocol != firewallAny {
+		if protocol == ICMPv6Protocol && rule.protocol == ICMPProtocol {
+			protocol = ICMPProtocol
+		}
+		if rule.protocol != protocol {
+			return false
+		}
+	}
+	if !rule.network.Contains(remote) {
+		return false
+	}
+	if rule.portMin == 0 && rule.portMax == 0xffff {
+		return true
+	}
+	return port >= 0 && uint16(port) >= rule.portMin && uint16(port) <= rule.portMax
+}
+
+func (fw *Firewall) Add(text string) error {
+	rule, err := ParseFirewallRule(text)
+	if err != nil {
+		return err
+	}
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if len(fw.rules) >= MaxFirewallRule {
+		return errors.New("too many firewall rules")
+	}
+	fw.rules = append(fw.rules, rule)
+	return nil
+}
+
+func (fw *Firewall) Clear() {
+	fw.mutex.Lock()
+	fw.rules = nil
+	fw.mutex.Unlock()
+}
+
+/* Reports whether the packet passes the rules,
+ * counting a hit on the deciding rule
+ */
+func (fw *Firewall) Allow(direction int, packet []byte) bool {
+	fw.mutex.RLock()
+	defer fw.mutex.RUnlock()
+	if len(fw.rules) == 0 || len(packet) == 0 {
+		return true
+	}
+
+	var protocol int
+	var offset int
+	var remote net.IP
+	port := -1 // unknown
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return true
+		}
+		offset = int(packet[0]&0x0f) * 4
+		protocol = int(packet[IPv4offsetProtocol])
+		if direction == FirewallOut {
+			remote = net.IP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+		} else {
+			remote = net.IP(packet[IPv4offsetSrc:IPv4offsetDst])
+		}
+		if binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&0x1fff != 0 {
+			offset = 0 // the transport header is in the first fragment
+		}
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return true
+		}
+		offset = ipv6.HeaderLen
+		protocol = int(packet[IPv6offsetNextHeader])
+		if direction == FirewallOut {
+			remote = net.IP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+		} else {
+			remote = net.IP(packet[IPv6offsetSrc:IPv6offsetDst])
+		}
+	default:
+		return true
+	}
+	if (protocol == TCPProtocol || protocol == UDPProtocol) && offset >= ipv4.HeaderLen && len(packet) >= offset+4 {
+		port = int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+
+	for _, rule := range fw.rules {
+		if rule.match(direction, protocol, remote, port) {
+			atomic.AddUint64(&rule.hits, 1)
+			return rule.allow
+		}
+	}
+	return true
+}
+
+func (fw *Firewall) Stats() []FirewallRuleStats {
+	fw.mutex.RLock()
+	defer fw.mutex.RUnlock()
+	stats := make([]FirewallRuleStats, 0, len(fw.rules))
+	for _, rule := range fw.rules {
+		stats = append(stats, FirewallRuleStats{
+			Rule: rule.text,
+			Hits: atomic.LoadUint64(&rule.hits),
+		})
+	}
+	return stats
+}
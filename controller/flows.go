@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Flow tracking
+ *
+ * Counts the packets carried by the tunnel per 5-tuple, oriented from the
+ * local side (the source of the packets read from the TUN), so that the
+ * application can show what is using the tunnel. The table is bounded,
+ * flows idle for FlowIdleTimeout are expired and when the table is full
+ * the least recently seen flow is evicted.
+ *
+ * Outbound packets are always tracked, the bytes a flow sent pick its
+ * priority lane. Received packets are only counted, and the flows only
+ * reported, when flow tracking is enabled.
+ */
+
+const (
+	MaxFlows          = 4096
+	FlowIdleTimeout   = time.Minute * 2
+	FlowSweepInterval = time.Second * 10
+	DefaultTopFlows   = 10
+)
+
+type flowKey struct {
+	local      [16]byte
+	remote     [16]byte
+	localPort  uint16
+	remotePort uint16
+	protocol   uint8
+}
+
+type Flow struct {
+	TxBytes   uint64
+	TxPackets uint64
+	RxBytes   uint64
+	RxPackets uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	element   *list.Element // in the recency list of the tracker
+}
+
+type DestinationStats struct {
+	Address   string `json:"address"`
+	Flows     int    `json:"flows"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	FirstSeen int64  `json:"first_seen"` // unix seconds
+	LastSeen  int64  `json:"last_seen"`
+}
+
+type FlowTracker struct {
+	enabled   AtomicBool
+	mutex     sync.Mutex
+	flows     map[flowKey]*Flow
+	recent    *list.List // keys, most recently seen first
+	lastSweep time.Time
+}
+
+/* Builds the key of packet, outbound packets are read from the TUN
+ */
+func parseFlowKey(packet []byte, outbound bool) (flowKey, bool) {
+	var key flowKey
+	var src, dst []byte
+	var offset int
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return key, false
+		}
+		offset = int(packet[0]&0x0f) * 4
+		if binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&0x1fff != 0 {
+			offset = 0 // the ports are in the first fragment
+		}
+		key.protocol = packet[IPv4offsetProtocol]
+		src = packet[IPv4offsetSrc:IPv4offsetDst]
+		dst = packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return key, false
+		}
+		offset = ipv6.HeaderLen
+		key.protocol = packet[IPv6offsetNextHeader]
+		src = packet[IPv6offsetSrc:IPv6offsetDst]
+		dst = packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+	default:
+		return key, false
+	}
+
+	var srcPort, dstPort uint16
+	if (key.protocol == TCPProtocol || key.protocol == UDPProtocol) && offset > 0 && len(packet) >= offset+4 {
+		srcPort = binary.BigEndian.Uint16(packet[offset:])
+		dstPort = binary.BigEndian.Uint16(packet[offset+2:])
+	}
+	if outbound {
+		copy(key.local[:], net.IP(src).To16())
+		copy(key.remote[:], net.IP(dst).To16())
+		key.localPort, key.remotePort = srcPort, dstPort
+	} else {
+		copy(key.local[:], net.IP(dst).To16())
+		copy(key.remote[:], net.IP(src).To16())
+		key.localPort, key.remotePort = dstPort, srcPort
+	}
+	return key, true
+}
+
+/* Counts packet in its flow,
+ * returns the bytes sent by the flow so far
+ */
+func (ft *FlowTracker) Track(packet []byte, outbound bool) uint64 {
+	if len(packet) == 0 || !outbound && !ft.enabled.Get() {
+		return 0
+	}
+	key, ok := parseFlowKey(packet, outbound)
+	if !ok {
+		return 0
+	}
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	now := time.Now() // under the mutex, the recency list stays ordered by LastSeen
+	if ft.flows == nil {
+		ft.flows = make(map[flowKey]*Flow)
+		ft.recent = list.New()
+	}
+	if now.Sub(ft.lastSweep) >= FlowSweepInterval {
+		ft.expireUnsafe(now)
+	}
+
+	flow := ft.flows[key]
+	if flow == nil {
+		if len(ft.flows) >= MaxFlows {
+			ft.evictUnsafe()
+		}
+		flow = &Flow{FirstSeen: now}
+		flow.element = ft.recent.PushFront(key)
+		ft.flows[key] = flow
+	} else {
+		ft.recent.MoveToFront(flow.element)
+	}
+	flow.LastSeen = now
+	if outbound {
+		flow.TxBytes += uint64(len(packet))
+		flow.TxPackets++
+	} else {
+		flow.RxBytes += uint64(len(packet))
+		flow.RxPackets++
+	}
+	return flow.TxBytes
+}
+
+/* Removes the idle flows, from the least recently seen
+ */
+func (ft *FlowTracker) expireUnsafe(now time.Time) {
+	ft.lastSweep = now
+	if ft.recent == nil {
+		return
+	}
+	for element := ft.recent.Back(); element != nil; element = ft.recent.Back() {
+		key := element.Value.(flowKey)
+		if now.Sub(ft.flows[key].LastSeen) <= FlowIdleTimeout {
+			return
+		}
+		ft.recent.Remove(element)
+		delete(ft.flows, key)
+	}
+}
+
+/* Removes the least recently seen flow
+ */
+func (ft *FlowTracker) evictUnsafe() {
+	element := ft.recent.Back()
+	if element == nil {
+		return
+	}
+	ft.recent.Remove(element)
+	delete(ft.flows, element.Value.(flowKey))
+}
+
+/* Enables counting received packets and reporting the flows,
+ * disabling forgets the flows seen so far
+ */
+func (ft *FlowTracker) SetEnabled(enabled bool) {
+	ft.enabled.Set(enabled)
+	if !enabled {
+		ft.mutex.Lock()
+		ft.flows = nil
+		ft.recent = nil
+		ft.mutex.Unlock()
+	}
+}
+
+/* Returns the number of flows reported, 0 when disabled
+ */
+func (ft *FlowTracker) Len() int {
+	if !ft.enabled.Get() {
+		return 0
+	}
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return len(ft.flows)
+}
+
+/* Aggregates the flows by remote address,
+ * returns at most n destinations by bytes carried, largest first
+ */
+func (ft *FlowTracker) TopDestinations(n int) []DestinationStats {
+	if n <= 0 {
+		n = DefaultTopFlows
+	}
+	now := time.Now()
+	destinations := make(map[[16]byte]*DestinationStats)
+
+	ft.mutex.Lock()
+	ft.expireUnsafe(now)
+	if !ft.enabled.Get() {
+		ft.mutex.Unlock()
+		return []DestinationStats{}
+	}
+	for key, flow := range ft.flows {
+		dest := destinations[key.remote]
+		if dest == nil {
+			dest = &DestinationStats{
+				Address:   ipString(key.remote),
+				FirstSeen: flow.FirstSeen.Unix(),
+			}
+			destinations[key.remote] = dest
+		}
+		dest.Flows++
+		dest.TxBytes += flow.TxBytes
+		dest.TxPackets += flow.TxPackets
+		dest.RxBytes += flow.RxBytes
+		dest.RxPackets += flow.RxPackets
+		if first := flow.FirstSeen.Unix(); first < dest.FirstSeen {
+			dest.FirstSeen = first
+		}
+		if last := flow.LastSeen.Unix(); last > dest.LastSeen {
+			dest.LastSeen = last
+		}
+	}
+	ft.mutex.Unlock()
+
+	list := make([]DestinationStats, 0, len(destinations))
+	for _, dest := range destinations {
+		list = append(list, *dest)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].TxBytes+list[i].RxBytes > list[j].TxBytes+list[j].RxBytes
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func ipString(addr [16]byte) string {
+	ip := net.IP(addr[:])
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+func (device *Device) TopDestinations(n int) []DestinationStats {
+	return device.flows.TopDestinations(n)
+}
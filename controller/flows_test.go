@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func testFlowPacket(port uint16) []byte {
+	packet := testSegment{seq: 1, flags: TCPFlagACK, payload: []byte{1}}.build()
+	binary.BigEndian.PutUint16(packet[20:], port)
+	return packet
+}
+
+func TestFlowTrackerEvictsLeastRecent(t *testing.T) {
+	var ft FlowTracker
+	ft.SetEnabled(true)
+	for i := 0; i < MaxFlows; i++ {
+		ft.Track(testFlowPacket(uint16(i)), true)
+	}
+	ft.Track(testFlowPacket(0), true) // seen again, no longer the oldest
+	ft.Track(testFlowPacket(MaxFlows), true)
+
+	if n := ft.Len(); n != MaxFlows {
+		t.Fatalf("%d flows, want %d", n, MaxFlows)
+	}
+	first, _ := parseFlowKey(testFlowPacket(0), true)
+	second, _ := parseFlowKey(testFlowPacket(1), true)
+	if flow := ft.flows[first]; flow == nil || flow.TxPackets != 2 {
+		t.Errorf("recently seen flow evicted")
+	}
+	if ft.flows[second] != nil {
+		t.Errorf("least recently seen flow kept")
+	}
+	if ft.recent.Len() != len(ft.flows) {
+		t.Errorf("%d keys in the recency list, %d flows", ft.recent.Len(), len(ft.flows))
+	}
+}
+
+func TestFlowTrackerExpires(t *testing.T) {
+	var ft FlowTracker
+	ft.SetEnabled(true)
+	for i := 0; i < 10; i++ {
+		ft.Track(testFlowPacket(uint16(i)), true)
+	}
+
+	// the 8 least recently seen flows went idle
+	ft.mutex.Lock()
+	element := ft.recent.Back()
+	for i := 0; i < 8; i++ {
+		flow := ft.flows[element.Value.(flowKey)]
+		flow.LastSeen = flow.LastSeen.Add(-FlowIdleTimeout * 2)
+		element = element.Prev()
+	}
+	ft.expireUnsafe(time.Now())
+	ft.mutex.Unlock()
+
+	if n := ft.Len(); n != 2 {
+		t.Errorf("%d flows after expiry, want 2", n)
+	}
+	for _, port := range []uint16{8, 9} {
+		if key, _ := parseFlowKey(testFlowPacket(port), true); ft.flows[key] == nil {
+			t.Errorf("active flow %d expired", port)
+		}
+	}
+
+	ft.SetEnabled(false)
+	if n := ft.Len(); n != 0 {
+		t.Errorf("%d flows after disabling", n)
+	}
+}
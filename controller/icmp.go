@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"bt/logger"
+)
+
+/* ICMP feedback
+ *
+ * Packets read from the TUN that are too large for the tunnel or have
+ * no route are answered with an ICMP error written back into the TUN
+ * (fragmentation needed / packet too big, destination unreachable),
+ * so that the inner stacks lower their path MTU or fail fast.
+ * Destinations excluded from the tunnel or bypassed are not errors,
+ * their packets are dropped silently.
+ * The error claims to come from the destination of the offending packet.
+ * No errors are sent about ICMP errors, non-first fragments
+ * or packets from or to multicast, broadcast and unspecified addresses.
+ */
+
+const (
+	ICMPFeedbackRate       = 50 // errors per second
+	ICMPHeaderLen          = 8
+	ICMPv4MaxErrorSize     = 576
+	ICMPv6MaxErrorSize     = 1280
+	ICMPv4DefaultTTL       = 64
+	IPv4FlagDontFragment   = 0x4000
+	icmpv4DestUnreachable  = 3
+	icmpv4NetUnreachable   = 0
+	icmpv4FragNeeded       = 4
+	icmpv6DestUnreachable  = 1
+	icmpv6PacketTooBig     = 2
+	icmpv6NoRoute          = 0
+	icmpv6InformationalMin = 128
+)
+
+type ICMPFeedback struct {
+	mutex  sync.Mutex
+	window time.Time
+	count  int
+}
+
+func (feedback *ICMPFeedback) allow() bool {
+	feedback.mutex.Lock()
+	defer feedback.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(feedback.window) >= time.Second {
+		feedback.window = now
+		feedback.count = 0
+	}
+	if feedback.count >= ICMPFeedbackRate {
+		return false
+	}
+	feedback.count++
+	return true
+}
+
+/* Reports whether an ICMP error may be sent about packet
+ */
+func icmpErrorAllowed(packet []byte) bool {
+	if len(packet) == 0 {
+		return false
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return false
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || ihl > len(packet) {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&0x1fff != 0 {
+			return false
+		}
+		src := net.IP(packet[IPv4offsetSrc:IPv4offsetDst])
+		dst := net.IP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+		if src.IsUnspecified() || src.IsMulticast() || src.Equal(net.IPv4bcast) ||
+			dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+			return false
+		}
+		if packet[IPv4offsetProtocol] == ICMPProtocol {
+			// only answer informational messages (echo and the like)
+			return len(packet) > ihl && isICMPv4Informational(packet[ihl])
+		}
+		return true
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return false
+		}
+		src := net.IP(packet[IPv6offsetSrc:IPv6offsetDst])
+		dst := net.IP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+		if src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() {
+			return false
+		}
+		if packet[IPv6offsetNextHeader] == ICMPv6Protocol {
+			return len(packet) > ipv6.HeaderLen && packet[ipv6.HeaderLen] >= icmpv6InformationalMin
+		}
+		return true
+	}
+	return false
+}
+
+func isICMPv4Informational(icmpType byte) bool {
+	switch icmpType {
+	case 0, 8, 13, 14, 15, 16, 17, 18:
+		return true
+	}
+	return false
+}
+
+/* Builds an ICMPv4 error about packet, preceded by headroom for the TUN framing,
+ * value goes into the second word of the ICMP header (next-hop MTU)
+ */
+func icmpv4Error(packet []byte, icmpType, code byte, value uint16) []byte {
+	quote := len(packet)
+	if quote > ICMPv4MaxErrorSize-ipv4.HeaderLen-ICMPHeaderLen {
+		quote = ICMPv4MaxErrorSize - ipv4.HeaderLen - ICMPHeaderLen
+	}
+	size := ipv4.HeaderLen + ICMPHeaderLen + quote
+	buffer := make([]byte, TunFramingHeaderSize+size)
+	reply := buffer[TunFramingHeaderSize:]
+
+	reply[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(reply[IPv4offsetTotalLength:], uint16(size))
+	reply[8] = ICMPv4DefaultTTL
+	reply[IPv4offsetProtocol] = ICMPProtocol
+	copy(reply[IPv4offsetSrc:], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len])
+	copy(reply[IPv4offsetDst:], packet[IPv4offsetSrc:IPv4offsetDst])
+	setIPv4Checksum(reply, ipv4.HeaderLen)
+
+	icmp := reply[ipv4.HeaderLen:]
+	icmp[0] = icmpType
+	icmp[1] = code
+	binary.BigEndian.PutUint16(icmp[6:], value)
+	copy(icmp[ICMPHeaderLen:], packet[:quote])
+	binary.BigEndian.PutUint16(icmp[2:], ^checksumFold(checksumAdd(icmp, 0)))
+	return buffer
+}
+
+/* Builds an ICMPv6 error about packet, preceded by headroom for the TUN framing,
+ * value goes into the second word of the ICMPv6 header (MTU)
+ */
+func icmpv6Error(packet []byte, icmpType, code byte, value uint32) []byte {
+	quote := len(packet)
+	if quote > ICMPv6MaxErrorSize-ipv6.HeaderLen-ICMPHeaderLen {
+		quote = ICMPv6MaxErrorSize - ipv6.HeaderLen - ICMPHeaderLen
+	}
+	size := ipv6.HeaderLen + ICMPHeaderLen + quote
+	buffer := make([]byte, TunFramingHeaderSize+size)
+	reply := buffer[TunFramingHeaderSize:]
+
+	reply[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(reply[IPv6offsetPayloadLength:], uint16(ICMPHeaderLen+quote))
+	reply[IPv6offsetNextHeader] = ICMPv6Protocol
+	reply[7] = 255 // hop limit
+	copy(reply[IPv6offsetSrc:], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len])
+	copy(reply[IPv6offsetDst:], packet[IPv6offsetSrc:IPv6offsetDst])
+
+	icmp := reply[ipv6.HeaderLen:]
+	icmp[0] = icmpType
+	icmp[1] = code
+	binary.BigEndian.PutUint32(icmp[4:], value)
+	copy(icmp[ICMPHeaderLen:], packet[:quote])
+	sum := pseudoHeaderSum(reply, ICMPv6Protocol, len(icmp))
+	binary.BigEndian.PutUint16(icmp[2:], ^checksumFold(checksumAdd(icmp, sum)))
+	return buffer
+}
+
+/* Answers a packet too large for the tunnel with
+ * fragmentation needed (IPv4 with DF set) or packet too big (IPv6)
+ */
+func (device *Device) sendPacketTooBig(packet []byte, mtu int) {
+	if !icmpErrorAllowed(packet) {
+		return
+	}
+	isIPv4 := packet[0]>>4 == ipv4.Version
+	if isIPv4 && binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&IPv4FlagDontFragment == 0 {
+		return
+	}
+	if !device.icmp.allow() {
+		return
+	}
+	var reply []byte
+	if isIPv4 {
+		reply = icmpv4Error(packet, icmpv4DestUnreachable, icmpv4FragNeeded, uint16(mtu))
+	} else {
+		if mtu < ICMPv6MaxErrorSize {
+			mtu = ICMPv6MaxErrorSize
+		}
+		reply = icmpv6Error(packet, icmpv6PacketTooBig, 0, uint32(mtu))
+	}
+	device.writeICMPError(reply)
+}
+
+/* Answers a packet without route with destination unreachable
+ */
+func (device *Device) sendUnreachable(packet []byte) {
+	if !icmpErrorAllowed(packet) || !device.icmp.allow() {
+		return
+	}
+	var reply []byte
+	if packet[0]>>4 == ipv4.Version {
+		reply = icmpv4Error(packet, icmpv4DestUnreachable, icmpv4NetUnreachable, 0)
+	} else {
+		reply = icmpv6Error(packet, icmpv6DestUnreachable, icmpv6NoRoute, 0)
+	}
+	device.writeICMPError(reply)
+}
+
+func (device *Device) writeICMPError(buffer []byte) {
+	device.capture.Write(buffer[TunFramingHeaderSize:])
+	if _, err := device.tun.device.Write(buffer, TunFramingHeaderSize); err != nil {
+		logger.Wlog.SaveErrLog("Failed to write ICMP error to TUN device:" + err.Error())
+	}
+}
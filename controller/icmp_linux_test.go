@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package controller
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestQueueFromTUNUnreachable(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+	device.tun.device = &NativeTun{fd: fds[0], errors: make(chan error, 5)}
+	peer, _ := device.NewPeer(NoisePublicKey{})
+	cidr := func(s string) *net.IPNet {
+		_, network, _ := net.ParseCIDR(s)
+		return network
+	}
+
+	for _, test := range []struct {
+		name    string
+		setup   func()
+		replied bool
+	}{
+		{"excluded", func() {
+			device.routingTable.Include(cidr("10.0.0.0/8"), peer)
+			device.routingTable.Exclude(cidr("10.0.0.2/32"))
+		}, false},
+		{"bypassed", func() {
+			set, _ := ParseRegionSet([]byte("10.0.0.0/24\n"))
+			device.bypass.set.Store(set)
+			device.routingTable.Include(cidr("10.0.0.0/8"), peer)
+		}, false},
+		{"no route", func() {
+			device.routingTable.Include(cidr("192.168.0.0/16"), peer)
+		}, true},
+	} {
+		device.routingTable.Reset()
+		device.bypass.set.Store((*RegionSet)(nil))
+		test.setup()
+
+		elem := &QueueOutboundElement{packet: testSegment{seq: 1, flags: TCPFlagSYN}.build()}
+		if device.queueFromTUN(elem) {
+			t.Fatalf("%s: packet queued", test.name)
+		}
+
+		reply := make([]byte, MaxMessageSize)
+		n, _, err := unix.Recvfrom(fds[1], reply, unix.MSG_DONTWAIT)
+		if !test.replied {
+			if err != unix.EAGAIN {
+				t.Errorf("%s: %d bytes written to the TUN", test.name, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: no ICMP error written: %v", test.name, err)
+		}
+		icmp := reply[ipv4HeaderLen(reply):n]
+		if icmp[0] != icmpv4DestUnreachable || icmp[1] != icmpv4NetUnreachable {
+			t.Errorf("%s: ICMP type %d code %d, want destination unreachable", test.name, icmp[0], icmp[1])
+		}
+	}
+}
+
+func ipv4HeaderLen(packet []byte) int {
+	return int(packet[0]&0x0f) * 4
+}
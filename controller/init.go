@@ -1,8 +1,9 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
-	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,6 +21,8 @@ var (
 	AllowIp                  = ""
 	Endpoint                 = ""
 	Netmask           uint32 = 0
+	AllowIp6                 = ""
+	Prefix6           uint8  = 128
 	UploadFlowNum            = 0
 	DownloadFlowNum          = 0
 	IntervalTime      int64  = 50
@@ -28,14 +31,19 @@ var (
 	UploadFlowChan    chan int
 	DownloadFlowChan  chan int
 	FdChan            chan int
-	DestinationIPChan chan string
+	QualityChan       chan string
+	RoutesChan        chan string
+	LeakChan          chan string
 	keepaliveMutex    sync.Mutex
+	protector         func(fd int) bool
 )
 
 func init() {
 	FdChan = make(chan int)
-	DestinationIPChan = make(chan string, 10)
 	StatusChan = make(chan int, 10)
+	QualityChan = make(chan string, 1)
+	RoutesChan = make(chan string, 1)
+	LeakChan = make(chan string, 1)
 	//DownloadFlowChan = make(chan int, 20)
 	//UploadFlowChan = make(chan int, 20)
 }
@@ -81,23 +89,28 @@ func sendFd(fd int) {
 	FdChan <- fd
 }
 
-//func sendDestinationIP(destinationIP string) {
-//	//t := time.NewTicker(time.Second)
-//	//
-//	//for {
-//	//	select {
-//	//	case <-d.WaitChannel():
-//	//		t.Stop()
-//	//		return
-//	//	case <-t.C:
-//	//		if destinationIP == "" {
-//	//			continue
-//	//		}
-//
-//	DestinationIPChan <- destinationIP
-//	//	}
-//	//}
-//}
+/* Registers the function excluding a socket from the tunnel (VpnService.protect),
+ * it is called on the dialing goroutine before the socket connects,
+ * so it must be set before Init
+ */
+func SetProtector(protect func(fd int) bool) {
+	protector = protect
+}
+
+/* Protects a stream socket before it connects, reports whether it was.
+ * Without a protector the socket is only marked, its fd is reported
+ * through FdChan once connected.
+ */
+func protectFd(fd uintptr) (bool, error) {
+	if protector == nil {
+		setMarkFd(fd, uint32(fwmarkIoctl))
+		return false, nil
+	}
+	if !protector(int(fd)) {
+		return false, errors.New("failed to protect socket " + strconv.Itoa(int(fd)))
+	}
+	return true, nil
+}
 
 //func taskSendFlow(d *Device) {
 //	t := time.NewTicker(1 * time.Second)
@@ -113,21 +126,6 @@ func sendFd(fd int) {
 //	}
 //}
 
-func taskGC(d *Device) {
-	if IsiOS {
-		t := time.NewTicker(3 * time.Second)
-		for {
-			select {
-			case <-d.WaitChannel():
-				t.Stop()
-				return
-			case <-t.C:
-				debug.FreeOSMemory()
-			}
-		}
-	}
-}
-
 func changeNetwork(device *Device, sourceAddr string) {
 	result := SetOperation(device, []string{"endpoint=" + sourceAddr})
 	if result != "" {
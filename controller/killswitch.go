@@ -0,0 +1,284 @@
+package controller
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Leak prevention
+ *
+ * The kill switch decides what happens to packets read from the TUN
+ * while the tunnel is not established (no usable key-pair):
+ * queue them until the handshake completes, dropping those older than
+ * the maximum age, drop them, or drop them, answer with ICMP
+ * administratively prohibited so that applications fail fast and
+ * report the drops to the app through LeakChan.
+ * With DNS leak protection, DNS packets to resolvers other than
+ * the tunnel DNS servers are rejected, whether the tunnel is up or not,
+ * so it can only be enabled along with the tunnel DNS servers.
+ */
+
+const (
+	KillSwitchQueue         = "queue"
+	KillSwitchBlock         = "block"
+	KillSwitchReport        = "report"
+	KillSwitchDefaultMaxAge = time.Second * 10
+	KillSwitchMaxAge        = time.Minute * 2
+	KillSwitchReportRate    = time.Second // at most one report per interval
+	icmpv4AdminProhibited   = 13
+	icmpv6AdminProhibited   = 1
+)
+
+const (
+	killSwitchQueue = iota
+	killSwitchBlock
+	killSwitchReport
+)
+
+/* Reasons for which packets are dropped by the leak prevention
+ */
+const (
+	LeakDropBlocked = iota
+	LeakDropExpired
+	LeakDropDNS
+	LeakDropCount
+)
+
+var leakDropNames = [LeakDropCount]string{
+	"blocked",
+	"expired",
+	"dns",
+}
+
+type KillSwitch struct {
+	maxAge     int64 // nanoseconds, 0 for the default, first for 64-bit alignment
+	lastReport int64 // unix nanoseconds
+	mode       int32
+	dnsLeak    AtomicBool
+	mutex      sync.RWMutex
+	dnsServers []net.IP
+}
+
+func (ks *KillSwitch) SetMode(mode string) error {
+	var value int32
+	switch mode {
+	case KillSwitchQueue:
+		value = killSwitchQueue
+	case KillSwitchBlock:
+		value = killSwitchBlock
+	case KillSwitchReport:
+		value = killSwitchReport
+	default:
+		return errors.New("invalid kill switch mode: " + mode)
+	}
+	atomic.StoreInt32(&ks.mode, value)
+	return nil
+}
+
+func (ks *KillSwitch) SetMaxAge(age time.Duration) error {
+	if age <= 0 || age > KillSwitchMaxAge {
+		return errors.New("maximum queue age out of range")
+	}
+	atomic.StoreInt64(&ks.maxAge, int64(age))
+	return nil
+}
+
+func (ks *KillSwitch) MaxAge() time.Duration {
+	age := atomic.LoadInt64(&ks.maxAge)
+	if age == 0 {
+		return KillSwitchDefaultMaxAge
+	}
+	return time.Duration(age)
+}
+
+/* Sets the tunnel DNS servers from a comma separated list
+ */
+func (ks *KillSwitch) SetDNSServers(list string) error {
+	var servers []net.IP
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return errors.New("invalid DNS server: " + field)
+		}
+		servers = append(servers, ip)
+	}
+	ks.mutex.Lock()
+	ks.dnsServers = servers
+	ks.mutex.Unlock()
+	return nil
+}
+
+func (ks *KillSwitch) hasDNSServers() bool {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	return len(ks.dnsServers) > 0
+}
+
+func (ks *KillSwitch) isTunnelDNS(ip net.IP) bool {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	for _, server := range ks.dnsServers {
+		if server.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Returns the destination of a UDP or TCP packet to the DNS port
+ */
+func dnsDestination(packet []byte) net.IP {
+	var protocol byte
+	var offset int
+	var dst net.IP
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		offset = int(packet[0]&0x0f) * 4
+		if offset < ipv4.HeaderLen ||
+			binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&0x1fff != 0 {
+			return nil
+		}
+		protocol = packet[IPv4offsetProtocol]
+		dst = net.IP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	case ipv6.Version:
+		offset = ipv6.HeaderLen
+		protocol = packet[IPv6offsetNextHeader]
+		dst = net.IP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	default:
+		return nil
+	}
+	if protocol != UDPProtocol && protocol != TCPProtocol {
+		return nil
+	}
+	if len(packet) < offset+4 || binary.BigEndian.Uint16(packet[offset+2:]) != DNSPort {
+		return nil
+	}
+	return dst
+}
+
+func (peer *Peer) established() bool {
+	keyPair := peer.keyPairs.Current()
+	return keyPair != nil &&
+		atomic.LoadUint64(&keyPair.sendNonce) < RejectAfterMessages &&
+		time.Now().Sub(keyPair.created) < RejectAfterTime
+}
+
+/* Applies the leak prevention to a packet read from the TUN,
+ * returns false if the packet must be dropped
+ */
+func (device *Device) filterLeaks(peer *Peer, elem *QueueOutboundElement) bool {
+	ks := &device.killSwitch
+	if ks.dnsLeak.Get() {
+		if dst := dnsDestination(elem.packet); dst != nil && !ks.isTunnelDNS(dst) {
+			device.counters.LeakDropped(LeakDropDNS)
+			device.sendProhibited(elem.packet)
+			device.reportLeak(LeakDropDNS, elem.packet)
+			return false
+		}
+	}
+
+	elem.queued = time.Now()
+	if peer.established() {
+		return true
+	}
+
+	// dropped packets never reach the nonce routine,
+	// which would otherwise ask for the handshake
+	switch atomic.LoadInt32(&ks.mode) {
+	case killSwitchBlock:
+		device.counters.LeakDropped(LeakDropBlocked)
+		signalSend(peer.signal.handshakeBegin)
+		return false
+	case killSwitchReport:
+		device.counters.LeakDropped(LeakDropBlocked)
+		device.sendProhibited(elem.packet)
+		device.reportLeak(LeakDropBlocked, elem.packet)
+		signalSend(peer.signal.handshakeBegin)
+		return false
+	}
+	return true
+}
+
+/* Reports whether a packet waited too long for the handshake
+ */
+func (device *Device) expired(elem *QueueOutboundElement) bool {
+	if elem.queued.IsZero() || atomic.LoadInt32(&device.killSwitch.mode) != killSwitchQueue {
+		return false
+	}
+	return time.Now().Sub(elem.queued) > device.killSwitch.MaxAge()
+}
+
+func (c *Counters) LeakDropped(reason int) {
+	atomic.AddUint64(&c.leakDrops[reason], 1)
+}
+
+/* Answers a rejected packet with destination unreachable,
+ * communication administratively prohibited
+ */
+func (device *Device) sendProhibited(packet []byte) {
+	if !icmpErrorAllowed(packet) || !device.icmp.allow() {
+		return
+	}
+	var reply []byte
+	if packet[0]>>4 == ipv4.Version {
+		reply = icmpv4Error(packet, icmpv4DestUnreachable, icmpv4AdminProhibited, 0)
+	} else {
+		reply = icmpv6Error(packet, icmpv6DestUnreachable, icmpv6AdminProhibited, 0)
+	}
+	device.writeICMPError(reply)
+}
+
+/* Dropped packets reported to the app in report mode
+ */
+type LeakReport struct {
+	Reason      string `json:"reason"` // as in leak_drops
+	Destination string `json:"destination"`
+	Dropped     uint64 `json:"dropped"` // packets dropped for the reason so far
+}
+
+/* Reports a packet dropped by the leak prevention in report mode,
+ * at most once per KillSwitchReportRate
+ */
+func (device *Device) reportLeak(reason int, packet []byte) {
+	ks := &device.killSwitch
+	if atomic.LoadInt32(&ks.mode) != killSwitchReport {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&ks.lastReport)
+	if now-last < int64(KillSwitchReportRate) || !atomic.CompareAndSwapInt64(&ks.lastReport, last, now) {
+		return
+	}
+
+	report := LeakReport{
+		Reason:  leakDropNames[reason],
+		Dropped: atomic.LoadUint64(&device.counters.leakDrops[reason]),
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		report.Destination = net.IP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]).String()
+	case ipv6.Version:
+		report.Destination = net.IP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]).String()
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	select {
+	case LeakChan <- string(b):
+	default:
+	}
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReportLeak(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	copy(packet[IPv4offsetDst:], []byte{8, 8, 8, 8})
+
+	// drained before and after, the channel is shared by the package
+	drain := func() {
+		select {
+		case <-LeakChan:
+		default:
+		}
+	}
+	drain()
+	defer drain()
+
+	device.reportLeak(LeakDropBlocked, packet)
+	select {
+	case s := <-LeakChan:
+		t.Fatalf("reported %s outside report mode", s)
+	default:
+	}
+
+	if err := device.killSwitch.SetMode("report"); err != nil {
+		t.Fatal(err)
+	}
+	device.counters.LeakDropped(LeakDropBlocked)
+	device.reportLeak(LeakDropBlocked, packet)
+	var report LeakReport
+	select {
+	case s := <-LeakChan:
+		if err := json.Unmarshal([]byte(s), &report); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("drop not reported")
+	}
+	if report.Reason != "blocked" || report.Destination != "8.8.8.8" || report.Dropped != 1 {
+		t.Errorf("reported %+v", report)
+	}
+
+	// further drops within the interval are only counted
+	device.reportLeak(LeakDropBlocked, packet)
+	select {
+	case s := <-LeakChan:
+		t.Errorf("reported %s twice within the interval", s)
+	default:
+	}
+
+	atomic.StoreInt64(&device.killSwitch.lastReport, 0)
+	device.reportLeak(LeakDropDNS, packet)
+	select {
+	case <-LeakChan:
+	default:
+		t.Error("drop not reported after the interval")
+	}
+}
+
+func TestSetDNSLeakProtection(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+
+	if err := SetOperation(device, []string{"dns_leak_protection=true"}); err == "" {
+		t.Error("dns_leak_protection without tunnel_dns accepted")
+	}
+	if device.killSwitch.dnsLeak.Get() {
+		t.Error("dns_leak_protection left on without tunnel_dns")
+	}
+
+	if err := SetOperation(device, []string{"dns_leak_protection=true", "tunnel_dns=10.0.0.1"}); err != "" {
+		t.Fatal(err)
+	}
+	if !device.killSwitch.dnsLeak.Get() {
+		t.Error("dns_leak_protection not enabled")
+	}
+}
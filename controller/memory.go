@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Memory budget
+ *
+ * Message buffers hold the bulk of the memory of the device.
+ * Buffers taken from the pool are counted until they are put back,
+ * the buffer of an element dropped while a worker may still hold it
+ * is only uncounted and left to the garbage collector.
+ *
+ * While the buffers in flight exceed the budget, the device sheds load
+ * by dropping data packets read from the TUN and received transport messages,
+ * handshake messages are never shed. Memory is returned to the OS
+ * when shedding starts rather than on a timer.
+ */
+
+const (
+	MemoryBudgetiOS      = 4 // MiB, default budget of the iOS network extension
+	MemoryMaxBudget      = 1024
+	MemoryFreeInterval   = time.Second
+	QueueMinSize         = 4
+	QueueMaxSize         = 4096
+	QueueOutbound        = 0
+	QueueInbound         = 1
+	QueueHandshake       = 2
+	queueConfigurable    = 3
+	memoryBudgetUnitSize = 1 << 20
+)
+
+type MemoryBudget struct {
+	limit      int64 // message buffers, 0 for no budget
+	inFlight   int64
+	queueSizes [queueConfigurable]int32
+	mutex      sync.Mutex
+	lastFree   time.Time
+}
+
+func (mb *MemoryBudget) init() {
+	mb.queueSizes[QueueOutbound] = QueueOutboundSize
+	mb.queueSizes[QueueInbound] = QueueInboundSize
+	mb.queueSizes[QueueHandshake] = QueueHandshakeSize
+}
+
+/* Sets the budget in MiB, 0 disables it
+ */
+func (mb *MemoryBudget) SetBudget(megabytes int) error {
+	if megabytes < 0 || megabytes > MemoryMaxBudget {
+		return errors.New("invalid memory budget")
+	}
+	atomic.StoreInt64(&mb.limit, int64(megabytes)*memoryBudgetUnitSize/MaxMessageSize)
+	return nil
+}
+
+func (mb *MemoryBudget) SetQueueSize(queue int, size int) error {
+	if queue < 0 || queue >= queueConfigurable {
+		return errors.New("invalid queue")
+	}
+	if size < QueueMinSize || size > QueueMaxSize {
+		return errors.New("invalid queue size")
+	}
+	atomic.StoreInt32(&mb.queueSizes[queue], int32(size))
+	return nil
+}
+
+func (mb *MemoryBudget) QueueSize(queue int) int {
+	return int(atomic.LoadInt32(&mb.queueSizes[queue]))
+}
+
+func (mb *MemoryBudget) InFlight() int {
+	return int(atomic.LoadInt64(&mb.inFlight))
+}
+
+func (mb *MemoryBudget) Exceeded() bool {
+	limit := atomic.LoadInt64(&mb.limit)
+	return limit > 0 && atomic.LoadInt64(&mb.inFlight) >= limit
+}
+
+func (mb *MemoryBudget) taken() {
+	atomic.AddInt64(&mb.inFlight, 1)
+}
+
+func (mb *MemoryBudget) returned() {
+	atomic.AddInt64(&mb.inFlight, -1)
+}
+
+/* Returns freed memory to the OS, at most once per interval
+ */
+func (mb *MemoryBudget) freeOSMemory() {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(mb.lastFree) < MemoryFreeInterval {
+		return
+	}
+	mb.lastFree = now
+	go debug.FreeOSMemory()
+}
+
+/* Returns true when a data packet must be shed
+ */
+func (device *Device) overBudget() bool {
+	if !device.memory.Exceeded() {
+		return false
+	}
+	device.counters.QueueDropped(QueueDropMemory)
+	device.memory.freeOSMemory()
+	return true
+}
+
+/* Uncounts the buffer of a dropped element that a worker may still hold,
+ * the buffer is not reused
+ */
+func (device *Device) releaseMessageBuffer() {
+	device.memory.returned()
+}
+
+/* Recreates the queues with the configured depths,
+ * called before the routines using them are started
+ */
+func (device *Device) resizeQueues() {
+	outbound := device.memory.QueueSize(QueueOutbound)
+	inbound := device.memory.QueueSize(QueueInbound)
+	handshake := device.memory.QueueSize(QueueHandshake)
+
+	if cap(device.queue.encryption) != outbound {
+		device.queue.encryption = make(chan *QueueOutboundElement, outbound)
+	}
+	if cap(device.queue.decryption) != inbound {
+		device.queue.decryption = make(chan *QueueInboundElement, inbound)
+	}
+	if cap(device.queue.handshake) != handshake {
+		device.queue.handshake = make(chan QueueHandshakeElement, handshake)
+	}
+
+	peer := device.peers
+	if peer == nil {
+		return
+	}
+	if cap(peer.queue.outbound) != outbound {
+		for lane := range peer.queue.nonce {
+			peer.queue.nonce[lane] = make(chan *QueueOutboundElement, outbound)
+		}
+		peer.queue.outbound = make(chan *QueueOutboundElement, outbound)
+	}
+	if cap(peer.queue.inbound) != inbound {
+		peer.queue.inbound = make(chan *QueueInboundElement, inbound)
+	}
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bt/logger"
+)
+
+/* OpenMetrics exporter
+ *
+ * Serves the device counters in the OpenMetrics text format
+ * https://github.com/OpenObservability/OpenMetrics
+ */
+
+const (
+	MetricsPrefix      = "bt_"
+	MetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+/* Quotes a label value, OpenMetrics only escapes backslash, quote and newline
+ */
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# TYPE %s%s %s\n", MetricsPrefix, name, typ)
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n", MetricsPrefix, name, help)
+}
+
+func (m *metricsWriter) counter(name, help string, value uint64) {
+	m.family(name, "counter", help)
+	fmt.Fprintf(m.w, "%s%s_total %d\n", MetricsPrefix, name, value)
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.family(name, "gauge", help)
+	fmt.Fprintf(m.w, "%s%s %s\n", MetricsPrefix, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metricsWriter) labeledCounter(name, help, label string, values map[string]uint64) {
+	m.family(name, "counter", help)
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(m.w, "%s%s_total{%s=%s} %d\n", MetricsPrefix, name, label, labelValue(k), values[k])
+	}
+}
+
+func (device *Device) WriteMetrics(w io.Writer) error {
+	stats := device.Stats()
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+
+	m.counter("rx_bytes", "Bytes received from the endpoint.", stats.RxBytes)
+	m.counter("rx_packets", "Datagrams received from the endpoint.", stats.RxPackets)
+	m.counter("tx_bytes", "Bytes sent to the endpoint.", stats.TxBytes)
+	m.counter("tx_packets", "Datagrams sent to the endpoint.", stats.TxPackets)
+
+	m.counter("handshake_initiation_sent", "Handshake initiations sent.", stats.HandshakeInitiationSent)
+	m.counter("handshake_initiation_received", "Handshake initiations received.", stats.HandshakeInitiationReceived)
+	m.counter("handshake_response_sent", "Handshake responses sent.", stats.HandshakeResponseSent)
+	m.counter("handshake_response_received", "Handshake responses received.", stats.HandshakeResponseReceived)
+	m.labeledCounter("handshake_failures", "Failed handshakes by reason.", "reason", stats.HandshakeFailures)
+
+	m.counter("cookie_reply_sent", "Cookie replies sent.", stats.CookieReplySent)
+	m.counter("cookie_reply_received", "Cookie replies received.", stats.CookieReplyReceived)
+
+	m.labeledCounter("queue_drops", "Elements dropped from full queues.", "queue", stats.QueueDrops)
+	m.labeledCounter("lane_drops", "Outbound packets dropped by priority lane.", "lane", stats.LaneDrops)
+	m.labeledCounter("leak_drops", "Packets dropped by the leak prevention.", "reason", stats.LeakDrops)
+	m.family("firewall_hits", "counter", "Packets matched by each firewall rule.")
+	for i, rule := range stats.Firewall {
+		fmt.Fprintf(m.w, "%sfirewall_hits_total{index=\"%d\",rule=%s} %d\n", MetricsPrefix, i, labelValue(rule.Rule), rule.Hits)
+	}
+	m.gauge("buffers_in_flight", "Message buffers taken from the pool.", float64(stats.BuffersInFlight))
+
+	m.gauge("keypair_age_seconds", "Age of the current key-pair, -1 if none.", stats.KeyPairAge)
+
+	m.gauge("mtu", "Effective MTU of the tunnel.", float64(stats.MTU))
+	m.gauge("flows", "Tracked flows.", float64(stats.Flows))
+
+	m.family("endpoint", "info", "Active endpoint.")
+	fmt.Fprintf(m.w, "%sendpoint_info{endpoint=%s} 1\n", MetricsPrefix, labelValue(stats.Endpoint))
+
+	m.gauge("rtt_seconds", "Smoothed round-trip time.", stats.Quality.SmoothedRTT/1000)
+	m.gauge("jitter_seconds", "Round-trip time variation.", stats.Quality.Jitter/1000)
+	m.gauge("loss_percent", "Smoothed inbound loss.", stats.Quality.LossPercent)
+
+	fmt.Fprint(m.w, "# EOF\n")
+	return m.w.Flush()
+}
+
+func (device *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	device.WriteMetrics(w)
+}
+
+/* Starts (or restarts) the metrics listener on addr
+ */
+func (device *Device) StartMetrics(addr string) error {
+	if addr == "" {
+		return errors.New("empty metrics address")
+	}
+
+	device.metrics.mutex.Lock()
+	defer device.metrics.mutex.Unlock()
+	device.stopMetricsLocked()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", device)
+	server := &http.Server{Handler: mux}
+	device.metrics.server = server
+
+	logger.Wlog.SaveInfoLog("metrics listening on:" + listener.Addr().String())
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Wlog.SaveErrLog("metrics listener stopped:" + err.Error())
+		}
+	}()
+
+	return nil
+}
+
+/* Stops the metrics listener, if any
+ */
+func (device *Device) StopMetrics() {
+	device.metrics.mutex.Lock()
+	defer device.metrics.mutex.Unlock()
+	device.stopMetricsLocked()
+}
+
+func (device *Device) stopMetricsLocked() {
+	if device.metrics.server != nil {
+		device.metrics.server.Close()
+		device.metrics.server = nil
+	}
+}
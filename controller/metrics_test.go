@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsLabelValue(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"udp", `"udp"`},
+		{`deny "out" \ tcp`, `"deny \"out\" \\ tcp"`},
+		{"a\nb", `"a\nb"`},
+		{"é\t\x01", "\"é\t\x01\""}, // left as is, unlike Go quoting
+	} {
+		if got := labelValue(test.value); got != test.want {
+			t.Errorf("labelValue(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMetricsWriteEOF(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+
+	var buffer bytes.Buffer
+	if err := device.WriteMetrics(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buffer.String(), "\n# EOF\n") {
+		t.Error("exposition does not end with # EOF")
+	}
+}
+
+func TestMetricsStartStop(t *testing.T) {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+
+	if device.StartMetrics("") == nil {
+		t.Error("listener started without an address")
+	}
+	if err := device.StartMetrics("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	device.metrics.mutex.Lock()
+	server := device.metrics.server
+	device.metrics.mutex.Unlock()
+	if server == nil {
+		t.Fatal("no metrics server")
+	}
+
+	// restart on a free port known to the test, the listener address is not exposed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	if err := device.StartMetrics(addr); err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.Header.Get("Content-Type") != MetricsContentType || !bytes.Contains(body, []byte("bt_rx_bytes_total")) {
+		t.Errorf("unexpected metrics response %q", body)
+	}
+
+	device.StopMetrics()
+	if _, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		t.Error("metrics served after StopMetrics")
+	}
+	device.StopMetrics()
+}
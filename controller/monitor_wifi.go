@@ -19,7 +19,7 @@ func monitorWifi(device *Device) {
 	for {
 		select {
 		case <-t.C:
-			if strings.HasPrefix(device.net.conn.LocalAddr().String(), "192.") {
+			if strings.HasPrefix(device.localAddr(), "192.") {
 				continue
 			}
 
@@ -35,7 +35,7 @@ func monitorWifi(device *Device) {
 					for _, v := range addresses {
 						if v.String() != "" && strings.HasPrefix(v.String(), "192.") {
 							interAddr := strings.Split(v.String(), "/")
-							localAddr := strings.Split(device.net.conn.LocalAddr().String(), ":")
+							localAddr := strings.Split(device.localAddr(), ":")
 							if interAddr[0] != localAddr[0] {
 								logger.Wlog.SaveInfoLog(fmt.Sprintf("监听网络变化:旧:%s,新:%s", localAddr[0], interAddr[0]))
 								changeNetwork(device, Endpoint)
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* TCP MSS clamping
+ *
+ * Lowers the MSS option of TCP SYN and SYN-ACK segments
+ * so that the segments of the connection fit the tunnel MTU.
+ * The TCP checksum is updated incrementally (RFC 1624).
+ */
+
+const (
+	TCPProtocol        = 6
+	TCPHeaderLen       = 20
+	TCPOffsetFlags     = 13
+	TCPOffsetChecksum  = 16
+	TCPFlagSYN         = 0x02
+	TCPOptionEnd       = 0
+	TCPOptionNop       = 1
+	TCPOptionMSS       = 2
+	TCPOptionMSSLength = 4
+)
+
+const (
+	IPv4offsetProtocol   = 9
+	IPv4offsetFragment   = 6
+	IPv6offsetNextHeader = 6
+)
+
+/* Returns the TCP segment of an unfragmented IPv4/IPv6 packet,
+ * or nil if the packet does not carry TCP
+ */
+func tcpSegment(packet []byte) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[IPv4offsetProtocol] != TCPProtocol {
+			return nil
+		}
+		if binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&0x1fff != 0 {
+			return nil
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || len(packet) < ihl+TCPHeaderLen {
+			return nil
+		}
+		return packet[ihl:]
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen+TCPHeaderLen || packet[IPv6offsetNextHeader] != TCPProtocol {
+			return nil
+		}
+		return packet[ipv6.HeaderLen:]
+	}
+	return nil
+}
+
+func checksumUpdate(sum, old, new uint16) uint16 {
+	acc := uint32(^sum) + uint32(^old) + uint32(new)
+	acc = (acc >> 16) + (acc & 0xffff)
+	acc += acc >> 16
+	return ^uint16(acc)
+}
+
+/* Clamps the MSS option of a SYN segment to fit into mtu,
+ * returns true if the packet was modified
+ */
+func clampMSS(packet []byte, mtu int) bool {
+	tcp := tcpSegment(packet)
+	if tcp == nil || tcp[TCPOffsetFlags]&TCPFlagSYN == 0 {
+		return false
+	}
+
+	mss := mtu - TCPHeaderLen - ipv4.HeaderLen
+	if packet[0]>>4 == ipv6.Version {
+		mss = mtu - TCPHeaderLen - ipv6.HeaderLen
+	}
+	if mss <= 0 {
+		return false
+	}
+
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < TCPHeaderLen || dataOffset > len(tcp) {
+		return false
+	}
+
+	options := tcp[TCPHeaderLen:dataOffset]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case TCPOptionEnd:
+			return false
+		case TCPOptionNop:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 {
+			return false
+		}
+		length := int(options[i+1])
+		if options[i] == TCPOptionMSS && length == TCPOptionMSSLength && i+length <= len(options) {
+			field := options[i+2 : i+4]
+			old := binary.BigEndian.Uint16(field)
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(field, uint16(mss))
+
+			// MSS value is 16-bit aligned within the header when i is even
+
+			checksum := binary.BigEndian.Uint16(tcp[TCPOffsetChecksum:])
+			if (TCPHeaderLen+i+2)%2 == 0 {
+				checksum = checksumUpdate(checksum, old, uint16(mss))
+			} else {
+				checksum = checksumUpdate(checksum, old>>8|old<<8, uint16(mss)>>8|uint16(mss)<<8)
+			}
+			binary.BigEndian.PutUint16(tcp[TCPOffsetChecksum:], checksum)
+			return true
+		}
+		i += length
+	}
+	return false
+}
@@ -33,14 +33,19 @@ const (
 	MessageTransportType   = 4
 )
 
+/* The legacy initiation is 176 bytes on the wire, the netmask takes 4 bytes:
+ * MessageInitiationSize used to say 173 (a 1 byte netmask), which never matched
+ * what binary.Write sent and failed the size check of received initiations.
+ */
 const (
-	MessageInitiationSize      = 173                                           //200                                           // size of handshake initation message
-	MessageResponseSize        = 92                                            // size of response message
-	MessageCookieReplySize     = 64                                            // size of cookie reply message
-	MessageTransportHeaderSize = 16                                            // size of data preceeding content in transport message
-	MessageTransportSize       = MessageTransportHeaderSize + poly1305.TagSize // size of empty transport
-	MessageKeepaliveSize       = MessageTransportSize                          // size of keepalive
-	MessageHandshakeSize       = MessageInitiationSize                         // size of largest handshake releated message
+	MessageInitiationV0Size    = MessageInitiationHeaderSize + legacyExtensionsSize + blake2s.Size128*2     // size of legacy handshake initation message
+	MessageInitiationV1Size    = MessageInitiationHeaderSize + legacyExtensionsIPv6Size + blake2s.Size128*2 // size of legacy handshake initation message with IPv6 address
+	MessageResponseSize        = 92                                                                         // size of response message
+	MessageCookieReplySize     = 64                                                                         // size of cookie reply message
+	MessageTransportHeaderSize = 16                                                                         // size of data preceeding content in transport message
+	MessageTransportSize       = MessageTransportHeaderSize + poly1305.TagSize                              // size of empty transport
+	MessageKeepaliveSize       = MessageTransportSize                                                       // size of keepalive
+	MessageHandshakeSize       = MessageInitiationMaxSize                                                   // size of largest handshake releated message
 )
 
 const (
@@ -56,27 +61,27 @@ const (
  */
 
 type MessageInitiation struct {
-	Type      uint32                                      //4
-	Sender    uint32                                      //4
-	Ephemeral NoisePublicKey                              //32
-	Static    [NoisePublicKeySize + poly1305.TagSize]byte //32+16
-	Timestamp [TAI64NSize + poly1305.TagSize]byte         //12+16
-	Ts        [timestampSize]byte                         //4
-	Sign      [signSize]byte                              //16
-	AllowIp   [allowIpSize]byte                           //4
-	Netmask   [netmaskSize]byte                           //1
-	MAC1      [blake2s.Size128]byte                       //16
-	MAC2      [blake2s.Size128]byte                       //16
+	Type       uint32                                      //4
+	Sender     uint32                                      //4
+	Ephemeral  NoisePublicKey                              //32
+	Static     [NoisePublicKeySize + poly1305.TagSize]byte //32+16
+	Timestamp  [TAI64NSize + poly1305.TagSize]byte         //12+16
+	Extensions ExtensionBlock                              // custom fields, see extension.go
+	sealed     []byte                                      // extension block as sent in extended initiations
+	MAC1       [blake2s.Size128]byte                       //16
+	MAC2       [blake2s.Size128]byte                       //16
 }
 
 type MessageResponse struct {
-	Type      uint32
-	Sender    uint32
-	Receiver  uint32
-	Ephemeral NoisePublicKey
-	Empty     [poly1305.TagSize]byte
-	MAC1      [blake2s.Size128]byte
-	MAC2      [blake2s.Size128]byte
+	Type       uint32
+	Sender     uint32
+	Receiver   uint32
+	Ephemeral  NoisePublicKey
+	Empty      [poly1305.TagSize]byte
+	Extensions ExtensionBlock // extended responses only
+	extensions []byte         // extension block as sent, mixed into the handshake hash
+	MAC1       [blake2s.Size128]byte
+	MAC2       [blake2s.Size128]byte
 }
 
 type MessageTransport struct {
@@ -107,6 +112,7 @@ type Handshake struct {
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
 	lastTimestamp             TAI64N
 	lastInitiationConsumption time.Time
+	extended                  bool // initiation sent or consumed in the extended layout
 }
 
 var (
@@ -222,17 +228,22 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 
 	handshake.mixHash(msg.Timestamp[:])
 
-	msg.Ts = newTimestampData()
-	msg.Sign = newSignData()
-	msg.AllowIp = newAllowIpData()
-	msg.Netmask = newNetmaskData()
+	msg.Extensions = newInitiationExtensions()
+	handshake.extended = device.extendedInitiation(peer)
+	if handshake.extended {
+		msg.Type = MessageInitiationExtendedType
+		msg.sealed, err = sealExtensions(&handshake.chainKey, &handshake.hash, &msg.Extensions)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	handshake.state = HandshakeInitiationCreated
 	return &msg, nil
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
-	if msg.Type != MessageInitiationType {
+	if msg.Type != MessageInitiationType && msg.Type != MessageInitiationExtendedType {
 		return nil
 	}
 
@@ -293,6 +304,16 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
+	// decrypt extensions
+
+	if msg.Type == MessageInitiationExtendedType {
+		msg.Extensions, err = openExtensions(&chainKey, &hash, msg.sealed)
+		if err != nil {
+			handshake.mutex.RUnlock()
+			return nil
+		}
+	}
+
 	// protect against replay & flood
 
 	var ok bool
@@ -313,6 +334,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.remoteEphemeral = msg.Ephemeral
 	handshake.lastTimestamp = timestamp
 	handshake.lastInitiationConsumption = time.Now()
+	handshake.extended = msg.Type == MessageInitiationExtendedType
 	handshake.state = HandshakeInitiationConsumed
 
 	handshake.mutex.Unlock()
@@ -320,7 +342,11 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	return peer
 }
 
-func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
+/* Creates the response to the consumed initiation,
+ * extensions is the negotiated block answering an extended initiation (nil otherwise),
+ * it is mixed into the hash authenticated by the empty payload
+ */
+func (device *Device) CreateMessageResponse(peer *Peer, extensions *ExtensionBlock) (*MessageResponse, error) {
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
@@ -328,6 +354,9 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	if handshake.state != HandshakeInitiationConsumed {
 		return nil, errors.New("handshake initation must be consumed first")
 	}
+	if handshake.extended != (extensions != nil) {
+		return nil, errors.New("response layout does not match the initiation")
+	}
 
 	// assign index
 
@@ -375,6 +404,16 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	handshake.mixHash(tau[:])
 
+	if extensions != nil {
+		msg.Type = MessageResponseExtendedType
+		msg.Extensions = *extensions
+		msg.extensions, err = extensions.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		handshake.mixHash(msg.extensions)
+	}
+
 	func() {
 		aead, _ := chacha20poly1305.New(key[:])
 		aead.Seal(msg.Empty[:0], ZeroNonce[:], nil, handshake.hash[:])
@@ -387,7 +426,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
-	if msg.Type != MessageResponseType {
+	if msg.Type != MessageResponseType && msg.Type != MessageResponseExtendedType {
 		return nil
 	}
 
@@ -414,6 +453,12 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			return false
 		}
 
+		// an extended initiation must be answered by an extended response
+
+		if handshake.extended != (msg.Type == MessageResponseExtendedType) {
+			return false
+		}
+
 		// finish 3-way DH
 
 		mixHash(&hash, &handshake.hash, msg.Ephemeral[:])
@@ -443,6 +488,9 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			handshake.presharedKey[:],
 		)
 		mixHash(&hash, &hash, tau[:])
+		if msg.Type == MessageResponseExtendedType {
+			mixHash(&hash, &hash, msg.extensions)
+		}
 
 		// authenticate
 
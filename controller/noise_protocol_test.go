@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+/* Returns a device with a fresh static key and its peer
+ */
+func newTestHandshakeDevice(t *testing.T) *Device {
+	device := newTestDevice(DefaultMTU)
+	device.indices.Init()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.privateKey = sk
+	device.publicKey = sk.publicKey()
+	device.mac.Init(device.publicKey)
+	return device
+}
+
+/* Returns an initiator and a responder knowing each other
+ */
+func newTestHandshakePair(t *testing.T) (*Device, *Device) {
+	initiator := newTestHandshakeDevice(t)
+	responder := newTestHandshakeDevice(t)
+	if _, err := initiator.NewPeer(responder.publicKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.NewPeer(initiator.publicKey); err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+/* Sets the custom fields of the initiations sent,
+ * the returned function restores them
+ */
+func setTestInitiationFields(allowIp6 string) func() {
+	ts, sign, allowIp, netmask, ip6, prefix6 := Ts, Sign, AllowIp, Netmask, AllowIp6, Prefix6
+	Ts = 1700000000
+	Sign = "00112233445566778899aabbccddeeff"
+	AllowIp = "10.8.0.2"
+	Netmask = 0xffffff00
+	AllowIp6 = allowIp6
+	Prefix6 = 64
+	return func() {
+		Ts, Sign, AllowIp, Netmask, AllowIp6, Prefix6 = ts, sign, allowIp, netmask, ip6, prefix6
+	}
+}
+
+func marshalInitiation(t *testing.T, device *Device) ([]byte, *MessageInitiation) {
+	peer := device.LookupPeer()
+	msg, err := device.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writer bytes.Buffer
+	if err := msg.marshal(&writer); err != nil {
+		t.Fatal(err)
+	}
+	packet := writer.Bytes()
+	peer.mac.AddMacs(packet)
+	return packet, msg
+}
+
+/* Checks MAC1 and consumes the initiation as RoutineHandshake does
+ */
+func consumeInitiation(device *Device, packet []byte) (*Peer, *MessageInitiation) {
+	if !device.mac.CheckMAC1(packet) {
+		return nil, nil
+	}
+	var msg MessageInitiation
+	if err := msg.unmarshal(packet); err != nil {
+		return nil, nil
+	}
+	return device.ConsumeMessageInitiation(&msg), &msg
+}
+
+func marshalResponse(t *testing.T, device *Device, peer *Peer, msg *MessageInitiation) []byte {
+	var extensions *ExtensionBlock
+	if msg.Type == MessageInitiationExtendedType {
+		negotiated := peer.extensions.Negotiate(&msg.Extensions)
+		extensions = &negotiated
+	}
+	response, err := device.CreateMessageResponse(peer, extensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writer bytes.Buffer
+	if err := response.marshal(&writer); err != nil {
+		t.Fatal(err)
+	}
+	packet := writer.Bytes()
+	peer.mac.AddMacs(packet)
+	return packet
+}
+
+func consumeResponse(device *Device, packet []byte) (*Peer, *MessageResponse) {
+	if !device.mac.CheckMAC1(packet) {
+		return nil, nil
+	}
+	var msg MessageResponse
+	if err := msg.unmarshal(packet); err != nil {
+		return nil, nil
+	}
+	return device.ConsumeMessageResponse(&msg), &msg
+}
+
+func TestHandshakeExtendedRoundTrip(t *testing.T) {
+	defer setTestInitiationFields("fd00::2")()
+	initiator, responder := newTestHandshakePair(t)
+	defer close(initiator.signal.stop)
+	defer close(responder.signal.stop)
+	initiator.SetHandshakeLayout(HandshakeLayoutExtended)
+
+	packet, sent := marshalInitiation(t, initiator)
+	if binary.LittleEndian.Uint32(packet) != MessageInitiationExtendedType {
+		t.Fatal("initiation not in the extended layout")
+	}
+	if len(packet) < MessageInitiationMinSize || len(packet) > MessageInitiationMaxSize {
+		t.Fatalf("initiation of %d bytes", len(packet))
+	}
+	plain, _ := sent.Extensions.Marshal()
+	sign := sent.Extensions.Get(ExtensionTypeSign)
+	if bytes.Contains(packet, plain) || bytes.Contains(packet, sign) {
+		t.Fatal("extension fields sent in the clear")
+	}
+
+	peer, received := consumeInitiation(responder, packet)
+	if peer != responder.LookupPeer() {
+		t.Fatal("extended initiation rejected")
+	}
+	for _, ext := range sent.Extensions.Extensions {
+		if !bytes.Equal(received.Extensions.Get(ext.Type), ext.Value) {
+			t.Errorf("extension %d decoded to %x, want %x", ext.Type, received.Extensions.Get(ext.Type), ext.Value)
+		}
+	}
+
+	packet = marshalResponse(t, responder, peer, received)
+	if binary.LittleEndian.Uint32(packet) != MessageResponseExtendedType {
+		t.Fatal("extended initiation not answered by an extended response")
+	}
+	peer, response := consumeResponse(initiator, packet)
+	if peer != initiator.LookupPeer() {
+		t.Fatal("extended response rejected")
+	}
+	peer.extensions.Negotiated(&response.Extensions)
+	for _, ext := range []uint8{ExtensionTypeTs, ExtensionTypeSign, ExtensionTypeAllowIp, ExtensionTypeNetmask, ExtensionTypeAllowIp6} {
+		if !peer.extensions.Accepted(ext) {
+			t.Errorf("extension %d not accepted", ext)
+		}
+	}
+
+	if initiator.peers.handshake.chainKey != responder.peers.handshake.chainKey ||
+		initiator.peers.handshake.hash != responder.peers.handshake.hash {
+		t.Error("initiator and responder derived different keys")
+	}
+}
+
+func TestHandshakeExtendedTampering(t *testing.T) {
+	defer setTestInitiationFields("")()
+	initiator, responder := newTestHandshakePair(t)
+	defer close(initiator.signal.stop)
+	defer close(responder.signal.stop)
+	initiator.SetHandshakeLayout(HandshakeLayoutExtended)
+
+	// MAC1 only needs the public key of the responder, an attacker altering
+	// the sealed fields recomputes it, the AEAD must catch the change
+
+	packet, _ := marshalInitiation(t, initiator)
+	smac1 := len(packet) - 32
+	for _, offset := range []int{
+		MessageInitiationHeaderSize,     // first byte of the sealed block
+		MessageInitiationHeaderSize + 5, // inside the sealed fields
+		smac1 - 1,                       // its tag
+		MessageInitiationHeaderSize - 1, // the encrypted timestamp
+	} {
+		tampered := append([]byte{}, packet...)
+		tampered[offset] ^= 1
+		initiator.peers.mac.AddMacs(tampered)
+		if peer, _ := consumeInitiation(responder, tampered); peer != nil {
+			t.Errorf("initiation with byte %d flipped accepted", offset)
+		}
+	}
+	tampered := append([]byte{}, packet...)
+	tampered[smac1] ^= 1
+	if peer, _ := consumeInitiation(responder, tampered); peer != nil {
+		t.Error("initiation with MAC1 flipped accepted")
+	}
+
+	// the untouched initiation is still accepted after the rejected ones
+
+	peer, received := consumeInitiation(responder, packet)
+	if peer == nil {
+		t.Fatal("initiation rejected")
+	}
+
+	packet = marshalResponse(t, responder, peer, received)
+	smac1 = len(packet) - 32
+	for _, offset := range []int{
+		MessageResponseHeaderSize - 1, // the sealed empty payload
+		smac1 - 1,                     // the accepted extension types
+	} {
+		tampered := append([]byte{}, packet...)
+		tampered[offset] ^= 1
+		responder.peers.mac.AddMacs(tampered)
+		if peer, _ := consumeResponse(initiator, tampered); peer != nil {
+			t.Errorf("response with byte %d flipped accepted", offset)
+		}
+	}
+	tampered = append([]byte{}, packet...)
+	tampered[smac1] ^= 1
+	if peer, _ := consumeResponse(initiator, tampered); peer != nil {
+		t.Error("response with MAC1 flipped accepted")
+	}
+
+	// a legacy response to an extended initiation is a downgrade
+
+	legacy := append([]byte{}, packet[:MessageResponseHeaderSize]...)
+	legacy = append(legacy, make([]byte, 32)...)
+	binary.LittleEndian.PutUint32(legacy, MessageResponseType)
+	responder.peers.mac.AddMacs(legacy)
+	if peer, _ := consumeResponse(initiator, legacy); peer != nil {
+		t.Error("legacy response to an extended initiation accepted")
+	}
+
+	if peer, _ := consumeResponse(initiator, packet); peer == nil {
+		t.Error("response rejected")
+	}
+}
+
+func TestHandshakeLegacyLayout(t *testing.T) {
+	defer setTestInitiationFields("")()
+	initiator, responder := newTestHandshakePair(t)
+	defer close(initiator.signal.stop)
+	defer close(responder.signal.stop)
+	initiator.SetHandshakeLayout(HandshakeLayoutLegacy)
+
+	packet, sent := marshalInitiation(t, initiator)
+	if len(packet) != MessageInitiationV0Size || MessageInitiationV0Size != 176 {
+		t.Fatalf("legacy initiation of %d bytes, want 176", len(packet))
+	}
+	if binary.LittleEndian.Uint32(packet) != MessageInitiationType {
+		t.Fatal("legacy initiation not of type 1")
+	}
+
+	// the fields deployed gateways read at fixed offsets
+
+	fields := packet[MessageInitiationHeaderSize:]
+	if binary.BigEndian.Uint32(fields) != Ts ||
+		!bytes.Equal(fields[4:20], sent.Extensions.Get(ExtensionTypeSign)) ||
+		!bytes.Equal(fields[20:24], []byte{10, 8, 0, 2}) ||
+		binary.BigEndian.Uint32(fields[24:]) != Netmask {
+		t.Fatalf("legacy fields %x", fields[:legacyExtensionsSize])
+	}
+
+	peer, received := consumeInitiation(responder, packet)
+	if peer == nil {
+		t.Fatal("legacy initiation rejected")
+	}
+	if received.Type != MessageInitiationType || received.Extensions.Get(ExtensionTypeAllowIp6) != nil {
+		t.Fatal("legacy initiation decoded with extensions")
+	}
+	for _, ext := range sent.Extensions.Extensions {
+		if !bytes.Equal(received.Extensions.Get(ext.Type), ext.Value) {
+			t.Errorf("field %d decoded to %x, want %x", ext.Type, received.Extensions.Get(ext.Type), ext.Value)
+		}
+	}
+
+	packet = marshalResponse(t, responder, peer, received)
+	if len(packet) != MessageResponseSize || binary.LittleEndian.Uint32(packet) != MessageResponseType {
+		t.Fatalf("legacy initiation answered with %d bytes of type %d", len(packet), binary.LittleEndian.Uint32(packet))
+	}
+	if peer, _ := consumeResponse(initiator, packet); peer == nil {
+		t.Fatal("legacy response rejected")
+	}
+}
+
+func TestHandshakeLegacyLayoutIPv6(t *testing.T) {
+	defer setTestInitiationFields("fd00::2")()
+	initiator, responder := newTestHandshakePair(t)
+	defer close(initiator.signal.stop)
+	defer close(responder.signal.stop)
+	initiator.SetHandshakeLayout(HandshakeLayoutLegacy)
+
+	packet, _ := marshalInitiation(t, initiator)
+	if len(packet) != MessageInitiationV1Size {
+		t.Fatalf("legacy initiation of %d bytes, want %d", len(packet), MessageInitiationV1Size)
+	}
+	_, received := consumeInitiation(responder, packet)
+	if received == nil {
+		t.Fatal("legacy initiation rejected")
+	}
+	_, addr6 := received.innerAddresses()
+	if addr6 == nil || addr6.String() != "fd00::/64" {
+		t.Errorf("requested IPv6 prefix decoded to %v", addr6)
+	}
+}
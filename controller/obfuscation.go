@@ -0,0 +1,206 @@
+package controller
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+/* Obfuscation of the outer UDP packets
+ *
+ * Applied to every packet right before it is written to the socket
+ * and right after it is read, so that both peers must use the same settings.
+ *
+ * The default transform scrambles the first 16 bytes (type, reserved bytes,
+ * indices and counter) with a mask derived from the shared key and
+ * the last 16 bytes of the packet, which must differ for every packet:
+ * the AEAD tag of transport messages, random padding of the others.
+ * Handshake messages get at least 16 bytes of random padding (their MAC2
+ * is all zero unless the peer is under load) plus a random length up to
+ * the configured padding, the padding length travels in the scrambled
+ * reserved bytes of the header.
+ * Junk packets of random size and content are sent before initiations.
+ */
+
+const (
+	ObfuscationHeaderSize     = 16
+	ObfuscationMinSize        = MessageKeepaliveSize
+	ObfuscationDefaultPadding = 64
+	ObfuscationMaxPadding     = 512
+	ObfuscationMaxJunk        = 16
+	ObfuscationJunkMinSize    = 40
+	ObfuscationJunkMaxSize    = 1200
+)
+
+type Obfuscator interface {
+	// Obfuscate transforms an outgoing packet, it may append to packet
+	Obfuscate(packet []byte) []byte
+
+	// Deobfuscate restores a received packet in place, nil drops the packet
+	Deobfuscate(packet []byte) []byte
+
+	// Junk returns the packets to send before a handshake initiation
+	Junk() [][]byte
+}
+
+type ScrambleObfuscator struct {
+	key     [blake2s.Size]byte
+	padding int
+	junk    int
+}
+
+func NewScrambleObfuscator(key string, padding int, junk int) (*ScrambleObfuscator, error) {
+	if key == "" {
+		return nil, errors.New("empty obfuscation key")
+	}
+	if padding < 0 || padding > ObfuscationMaxPadding {
+		return nil, errors.New("invalid obfuscation padding")
+	}
+	if junk < 0 || junk > ObfuscationMaxJunk {
+		return nil, errors.New("invalid obfuscation junk count")
+	}
+	return &ScrambleObfuscator{
+		key:     blake2s.Sum256([]byte(key)),
+		padding: padding,
+		junk:    junk,
+	}, nil
+}
+
+func (o *ScrambleObfuscator) scramble(packet []byte) {
+	mac, _ := blake2s.New256(o.key[:])
+	mac.Write(packet[len(packet)-ObfuscationHeaderSize:])
+	var mask [blake2s.Size]byte
+	mac.Sum(mask[:0])
+	for i := 0; i < ObfuscationHeaderSize; i++ {
+		packet[i] ^= mask[i]
+	}
+}
+
+func (o *ScrambleObfuscator) Obfuscate(packet []byte) []byte {
+	if len(packet) < ObfuscationMinSize {
+		return packet
+	}
+	if packet[0] != MessageTransportType {
+		pad := ObfuscationHeaderSize + rand.Intn(o.padding+1)
+		size := len(packet)
+		packet = append(packet, make([]byte, pad)...)
+		crand.Read(packet[size:])
+		binary.LittleEndian.PutUint16(packet[1:3], uint16(pad))
+	}
+	o.scramble(packet)
+	return packet
+}
+
+func (o *ScrambleObfuscator) Deobfuscate(packet []byte) []byte {
+	if len(packet) < ObfuscationMinSize {
+		return nil
+	}
+	o.scramble(packet)
+	if packet[0] != MessageTransportType {
+		pad := int(binary.LittleEndian.Uint16(packet[1:3]))
+		if len(packet)-pad < ObfuscationMinSize {
+			return nil
+		}
+		packet = packet[:len(packet)-pad]
+		packet[1] = 0
+		packet[2] = 0
+	}
+	return packet
+}
+
+func (o *ScrambleObfuscator) Junk() [][]byte {
+	junk := make([][]byte, o.junk)
+	for i := range junk {
+		size := ObfuscationJunkMinSize + rand.Intn(ObfuscationJunkMaxSize-ObfuscationJunkMinSize+1)
+		junk[i] = make([]byte, size)
+		crand.Read(junk[i])
+	}
+	return junk
+}
+
+/* Obfuscation settings of the device,
+ * the transform is rebuilt whenever a setting changes
+ */
+type Obfuscation struct {
+	mutex      sync.Mutex
+	key        string
+	padding    int
+	junk       int
+	configured bool // padding has been set explicitly
+	current    atomic.Value
+}
+
+type obfuscatorHolder struct {
+	obfuscator Obfuscator
+}
+
+func (obf *Obfuscation) Get() Obfuscator {
+	holder, _ := obf.current.Load().(obfuscatorHolder)
+	return holder.obfuscator
+}
+
+/* Installs a custom transform, nil disables obfuscation
+ */
+func (obf *Obfuscation) Set(obfuscator Obfuscator) {
+	obf.current.Store(obfuscatorHolder{obfuscator: obfuscator})
+}
+
+func (obf *Obfuscation) SetKey(key string) error {
+	obf.mutex.Lock()
+	defer obf.mutex.Unlock()
+	obf.key = key
+	return obf.rebuildLocked()
+}
+
+func (obf *Obfuscation) SetPadding(padding int) error {
+	obf.mutex.Lock()
+	defer obf.mutex.Unlock()
+	obf.padding = padding
+	obf.configured = true
+	return obf.rebuildLocked()
+}
+
+func (obf *Obfuscation) SetJunk(junk int) error {
+	obf.mutex.Lock()
+	defer obf.mutex.Unlock()
+	obf.junk = junk
+	return obf.rebuildLocked()
+}
+
+/* Caller must hold the mutex
+ */
+func (obf *Obfuscation) rebuildLocked() error {
+	if obf.key == "" {
+		obf.Set(nil)
+		return nil
+	}
+	padding := obf.padding
+	if !obf.configured {
+		padding = ObfuscationDefaultPadding
+	}
+	obfuscator, err := NewScrambleObfuscator(obf.key, padding, obf.junk)
+	if err != nil {
+		return err
+	}
+	obf.Set(obfuscator)
+	return nil
+}
+
+/* Sends the junk packets of the obfuscator to the peer
+ */
+func (peer *Peer) SendJunk() {
+	obfuscator := peer.device.obfuscation.Get()
+	if obfuscator == nil {
+		return
+	}
+	for _, junk := range obfuscator.Junk() {
+		if _, err := peer.send(junk); err != nil {
+			return
+		}
+	}
+}
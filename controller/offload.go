@@ -0,0 +1,449 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* TUN offloads (Linux)
+ *
+ * A TUN opened with IFF_VNET_HDR prefixes every packet with a virtio-net header.
+ * With TSO enabled the kernel hands over TCP super-packets of up to 64 KiB,
+ * they are split into MTU sized segments before the nonce queue.
+ * In the other direction consecutive segments of a TCP flow are coalesced
+ * into one super-packet, so that a single write carries many segments.
+ */
+
+const (
+	VirtioNetHdrSize     = 10
+	OffloadMaxPacketSize = 65535
+	OffloadBufferSize    = VirtioNetHdrSize + OffloadMaxPacketSize
+)
+
+const (
+	virtioNetHdrFlagNeedsCsum = 1
+	virtioNetHdrGSONone       = 0
+	virtioNetHdrGSOTCPv4      = 1
+	virtioNetHdrGSOTCPv6      = 4
+)
+
+const (
+	TCPOffsetSeq        = 4
+	TCPOffsetAck        = 8
+	TCPOffsetDataOffset = 12
+	TCPFlagFIN          = 0x01
+	TCPFlagPSH          = 0x08
+	TCPFlagACK          = 0x10
+	IPv4offsetID        = 4
+	IPv4offsetChecksum  = 10
+)
+
+/* Header in host byte order (little endian on the supported architectures)
+ */
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (hdr *virtioNetHdr) unmarshal(b []byte) error {
+	if len(b) < VirtioNetHdrSize {
+		return errors.New("short virtio-net header")
+	}
+	hdr.flags = b[0]
+	hdr.gsoType = b[1]
+	hdr.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	hdr.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	hdr.csumStart = binary.LittleEndian.Uint16(b[6:])
+	hdr.csumOffset = binary.LittleEndian.Uint16(b[8:])
+	return nil
+}
+
+func (hdr *virtioNetHdr) marshal(b []byte) {
+	b[0] = hdr.flags
+	b[1] = hdr.gsoType
+	binary.LittleEndian.PutUint16(b[2:], hdr.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], hdr.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], hdr.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], hdr.csumOffset)
+}
+
+func checksumAdd(b []byte, sum uint32) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+/* Sum of the pseudo header of the IP packet for a transport segment of length bytes
+ */
+func pseudoHeaderSum(packet []byte, protocol uint8, length int) uint32 {
+	var sum uint32
+	if packet[0]>>4 == ipv4.Version {
+		sum = checksumAdd(packet[IPv4offsetSrc:IPv4offsetDst+net.IPv4len], 0)
+	} else {
+		sum = checksumAdd(packet[IPv6offsetSrc:IPv6offsetDst+net.IPv6len], 0)
+	}
+	return sum + uint32(protocol) + uint32(length)
+}
+
+func tcpChecksumValid(packet []byte, iphLen int) bool {
+	sum := pseudoHeaderSum(packet, TCPProtocol, len(packet)-iphLen)
+	return checksumFold(checksumAdd(packet[iphLen:], sum)) == 0xffff
+}
+
+func setIPv4Checksum(packet []byte, iphLen int) {
+	binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], 0)
+	binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], ^checksumFold(checksumAdd(packet[:iphLen], 0)))
+}
+
+/* Splits a packet read with its virtio-net header into segments of at most mtu bytes,
+ * next returns the destination of a segment of size bytes (nil stops splitting),
+ * a packet without GSO larger than mtu is handed to tooBig instead,
+ * returns the number of segments written
+ */
+func offloadSegments(hdr *virtioNetHdr, packet []byte, mtu int, next func(size int) []byte, tooBig func(packet []byte)) (int, error) {
+	if hdr.gsoType == virtioNetHdrGSONone {
+		if hdr.flags&virtioNetHdrFlagNeedsCsum != 0 {
+			start := int(hdr.csumStart)
+			field := start + int(hdr.csumOffset)
+			if field+2 > len(packet) {
+				return 0, errors.New("invalid checksum offset")
+			}
+			// the field holds the pseudo header sum
+			sum := checksumFold(checksumAdd(packet[start:], 0))
+			binary.BigEndian.PutUint16(packet[field:], ^sum)
+		}
+		if len(packet) > mtu {
+			tooBig(packet)
+			return 0, nil
+		}
+		dst := next(len(packet))
+		if dst == nil {
+			return 0, nil
+		}
+		copy(dst, packet)
+		return 1, nil
+	}
+
+	if hdr.gsoType != virtioNetHdrGSOTCPv4 && hdr.gsoType != virtioNetHdrGSOTCPv6 {
+		return 0, errors.New("unsupported GSO type")
+	}
+	iphLen := int(hdr.csumStart)
+	if hdr.gsoType == virtioNetHdrGSOTCPv4 && (iphLen < ipv4.HeaderLen || packet[0]>>4 != ipv4.Version) {
+		return 0, errors.New("invalid TCPv4 super-packet")
+	}
+	if hdr.gsoType == virtioNetHdrGSOTCPv6 && (iphLen != ipv6.HeaderLen || packet[0]>>4 != ipv6.Version) {
+		return 0, errors.New("invalid TCPv6 super-packet")
+	}
+	if len(packet) < iphLen+TCPHeaderLen {
+		return 0, errors.New("short super-packet")
+	}
+	tcphLen := int(packet[iphLen+TCPOffsetDataOffset]>>4) * 4
+	hlen := iphLen + tcphLen
+	if tcphLen < TCPHeaderLen || hlen > len(packet) {
+		return 0, errors.New("invalid TCP header")
+	}
+
+	segmentSize := int(hdr.gsoSize)
+	if segmentSize > mtu-hlen {
+		segmentSize = mtu - hlen
+	}
+	if segmentSize <= 0 {
+		return 0, errors.New("invalid segment size")
+	}
+
+	payload := packet[hlen:]
+	seq := binary.BigEndian.Uint32(packet[iphLen+TCPOffsetSeq:])
+	flags := packet[iphLen+TCPOffsetFlags]
+	var id uint16
+	if hdr.gsoType == virtioNetHdrGSOTCPv4 {
+		id = binary.BigEndian.Uint16(packet[IPv4offsetID:])
+	}
+
+	segments := 0
+	for offset := 0; offset < len(payload); offset += segmentSize {
+		end := offset + segmentSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		size := hlen + end - offset
+		dst := next(size)
+		if dst == nil {
+			break
+		}
+		copy(dst, packet[:hlen])
+		copy(dst[hlen:], payload[offset:end])
+
+		if hdr.gsoType == virtioNetHdrGSOTCPv4 {
+			binary.BigEndian.PutUint16(dst[IPv4offsetTotalLength:], uint16(size))
+			binary.BigEndian.PutUint16(dst[IPv4offsetID:], id+uint16(segments))
+			setIPv4Checksum(dst, iphLen)
+		} else {
+			binary.BigEndian.PutUint16(dst[IPv6offsetPayloadLength:], uint16(size-iphLen))
+		}
+
+		tcp := dst[iphLen:]
+		binary.BigEndian.PutUint32(tcp[TCPOffsetSeq:], seq+uint32(offset))
+		if end < len(payload) {
+			tcp[TCPOffsetFlags] = flags &^ (TCPFlagFIN | TCPFlagPSH)
+		}
+		binary.BigEndian.PutUint16(tcp[TCPOffsetChecksum:], 0)
+		sum := checksumAdd(tcp, pseudoHeaderSum(dst, TCPProtocol, len(tcp)))
+		binary.BigEndian.PutUint16(tcp[TCPOffsetChecksum:], ^checksumFold(sum))
+		segments++
+	}
+	return segments, nil
+}
+
+/* Coalesces consecutive TCP segments of a flow into a super-packet,
+ * other packets are written as they come
+ */
+type tcpCoalescer struct {
+	mutex    sync.Mutex
+	write    func(b []byte) (int, error)
+	buffer   [OffloadBufferSize]byte // virtio-net header and super-packet in progress
+	single   [OffloadBufferSize]byte
+	size     int // bytes of the super-packet
+	segments int
+	iphLen   int
+	hlen     int
+	gsoSize  int
+	nextSeq  uint32
+	closed   bool // no more segments may follow
+}
+
+/* Returns the IP and TCP header lengths if the packet may be coalesced,
+ * a zero TCP header length otherwise
+ */
+func coalescable(packet []byte) (int, int) {
+	tcp := tcpSegment(packet)
+	if tcp == nil {
+		return 0, 0
+	}
+	iphLen := len(packet) - len(tcp)
+	if packet[0]>>4 == ipv4.Version && iphLen != ipv4.HeaderLen {
+		return 0, 0
+	}
+	tcphLen := int(tcp[TCPOffsetDataOffset]>>4) * 4
+	if tcphLen < TCPHeaderLen || tcphLen >= len(tcp) {
+		return 0, 0
+	}
+	if tcp[TCPOffsetFlags]&^TCPFlagPSH != TCPFlagACK {
+		return 0, 0
+	}
+	if !tcpChecksumValid(packet, iphLen) {
+		return 0, 0
+	}
+	return iphLen, tcphLen
+}
+
+/* Compares the headers of a segment with the super-packet,
+ * ignoring lengths, IPv4 id, checksums, sequence number and PSH
+ */
+func (c *tcpCoalescer) sameFlow(packet []byte, iphLen int, hlen int) bool {
+	head := c.buffer[VirtioNetHdrSize:]
+	if iphLen != c.iphLen || hlen != c.hlen {
+		return false
+	}
+	if iphLen == ipv4.HeaderLen {
+		if !bytes.Equal(packet[0:2], head[0:2]) || !bytes.Equal(packet[6:10], head[6:10]) ||
+			!bytes.Equal(packet[IPv4offsetSrc:iphLen], head[IPv4offsetSrc:iphLen]) {
+			return false
+		}
+	} else {
+		if !bytes.Equal(packet[0:4], head[0:4]) || !bytes.Equal(packet[6:iphLen], head[6:iphLen]) {
+			return false
+		}
+	}
+	tcp := packet[iphLen:]
+	ctcp := head[iphLen:]
+	return bytes.Equal(tcp[0:TCPOffsetSeq], ctcp[0:TCPOffsetSeq]) &&
+		bytes.Equal(tcp[TCPOffsetAck:TCPOffsetFlags], ctcp[TCPOffsetAck:TCPOffsetFlags]) &&
+		tcp[TCPOffsetFlags]&^TCPFlagPSH == ctcp[TCPOffsetFlags]&^TCPFlagPSH &&
+		bytes.Equal(tcp[TCPOffsetFlags+1:TCPOffsetChecksum], ctcp[TCPOffsetFlags+1:TCPOffsetChecksum]) &&
+		bytes.Equal(tcp[TCPHeaderLen:hlen-iphLen], ctcp[TCPHeaderLen:hlen-iphLen])
+}
+
+func (c *tcpCoalescer) Add(packet []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	iphLen, tcphLen := coalescable(packet)
+	if tcphLen == 0 {
+		if err := c.flushLocked(); err != nil {
+			return err
+		}
+		return c.writeSingleLocked(packet)
+	}
+
+	hlen := iphLen + tcphLen
+	tcp := packet[iphLen:]
+	seq := binary.BigEndian.Uint32(tcp[TCPOffsetSeq:])
+	payload := len(packet) - hlen
+
+	if c.segments > 0 && !c.closed && c.sameFlow(packet, iphLen, hlen) &&
+		seq == c.nextSeq && payload <= c.gsoSize && c.size+payload <= OffloadMaxPacketSize {
+
+		copy(c.buffer[VirtioNetHdrSize+c.size:], packet[hlen:])
+		c.size += payload
+		c.segments++
+		c.nextSeq += uint32(payload)
+		if tcp[TCPOffsetFlags]&TCPFlagPSH != 0 {
+			c.buffer[VirtioNetHdrSize+iphLen+TCPOffsetFlags] |= TCPFlagPSH
+			c.closed = true
+		}
+		if payload < c.gsoSize {
+			c.closed = true
+		}
+		return nil
+	}
+
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	copy(c.buffer[VirtioNetHdrSize:], packet)
+	c.size = len(packet)
+	c.segments = 1
+	c.iphLen = iphLen
+	c.hlen = hlen
+	c.gsoSize = payload
+	c.nextSeq = seq + uint32(payload)
+	c.closed = tcp[TCPOffsetFlags]&TCPFlagPSH != 0
+	return nil
+}
+
+func (c *tcpCoalescer) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.flushLocked()
+}
+
+/* Writes a packet without offload,
+ * after the super-packet in progress so that it is not overtaken
+ */
+func (c *tcpCoalescer) WriteSingle(packet []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	return c.writeSingleLocked(packet)
+}
+
+/* Caller must hold the mutex
+ */
+func (c *tcpCoalescer) writeSingleLocked(packet []byte) error {
+	if len(packet) > OffloadMaxPacketSize {
+		return errors.New("packet too large")
+	}
+	var hdr virtioNetHdr
+	hdr.marshal(c.single[:])
+	copy(c.single[VirtioNetHdrSize:], packet)
+	_, err := c.write(c.single[:VirtioNetHdrSize+len(packet)])
+	return err
+}
+
+/* Caller must hold the mutex
+ */
+func (c *tcpCoalescer) flushLocked() error {
+	if c.segments == 0 {
+		return nil
+	}
+
+	var hdr virtioNetHdr
+	packet := c.buffer[VirtioNetHdrSize : VirtioNetHdrSize+c.size]
+	if c.segments > 1 {
+		if c.iphLen == ipv4.HeaderLen {
+			binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(c.size))
+			setIPv4Checksum(packet, c.iphLen)
+			hdr.gsoType = virtioNetHdrGSOTCPv4
+		} else {
+			binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(c.size-c.iphLen))
+			hdr.gsoType = virtioNetHdrGSOTCPv6
+		}
+		hdr.flags = virtioNetHdrFlagNeedsCsum
+		hdr.hdrLen = uint16(c.hlen)
+		hdr.gsoSize = uint16(c.gsoSize)
+		hdr.csumStart = uint16(c.iphLen)
+		hdr.csumOffset = TCPOffsetChecksum
+
+		// the kernel completes the checksum from the pseudo header sum
+		sum := pseudoHeaderSum(packet, TCPProtocol, c.size-c.iphLen)
+		binary.BigEndian.PutUint16(packet[c.iphLen+TCPOffsetChecksum:], checksumFold(sum))
+	}
+	hdr.marshal(c.buffer[:])
+	c.segments = 0
+	_, err := c.write(c.buffer[:VirtioNetHdrSize+c.size])
+	return err
+}
+
+func (tun *NativeTun) Offload() bool {
+	return tun.coalescer != nil
+}
+
+/* Reads a packet from a TUN with offloads and splits it into segments,
+ * see offloadSegments
+ */
+func (tun *NativeTun) ReadSegments(mtu int, next func(size int) []byte, tooBig func(packet []byte)) (int, error) {
+	n, err := tunRead(tun.fd, tun.offloadBuffer)
+	if err != nil {
+		return 0, err
+	}
+	var hdr virtioNetHdr
+	if err := hdr.unmarshal(tun.offloadBuffer[:n]); err != nil {
+		return 0, err
+	}
+	return offloadSegments(&hdr, tun.offloadBuffer[VirtioNetHdrSize:n], mtu, next, tooBig)
+}
+
+/* Writes the packet at buffer[offset:] (see Write),
+ * TCP segments are held back for coalescing until Flush
+ */
+func (tun *NativeTun) WritePacket(buffer []byte, offset int) error {
+	if tun.coalescer == nil {
+		_, err := tun.Write(buffer, offset)
+		return err
+	}
+	return tun.coalescer.Add(buffer[offset:])
+}
+
+func (tun *NativeTun) Flush() error {
+	if tun.coalescer == nil {
+		return nil
+	}
+	return tun.coalescer.Flush()
+}
+
+func (tun *NativeTun) enableOffload() {
+	if !tunOffloadSupported(tun.fd) {
+		return
+	}
+	fd := tun.fd
+	tun.offloadBuffer = make([]byte, OffloadBufferSize)
+	tun.coalescer = &tcpCoalescer{
+		write: func(b []byte) (int, error) {
+			return tunWrite(fd, b)
+		},
+	}
+}
@@ -0,0 +1,464 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+/* Internet checksum computed byte by byte, independent of checksumAdd
+ */
+func referenceChecksum(chunks ...[]byte) uint16 {
+	var sum uint64
+	odd := false
+	for _, chunk := range chunks {
+		for _, b := range chunk {
+			if odd {
+				sum += uint64(b)
+			} else {
+				sum += uint64(b) << 8
+			}
+			odd = !odd
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func referencePseudoHeader(packet []byte, length int) []byte {
+	var pseudo []byte
+	if packet[0]>>4 == 4 {
+		pseudo = append(pseudo, packet[12:20]...)
+		pseudo = append(pseudo, 0, TCPProtocol)
+		pseudo = append(pseudo, byte(length>>8), byte(length))
+	} else {
+		pseudo = append(pseudo, packet[8:40]...)
+		pseudo = append(pseudo, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+		pseudo = append(pseudo, 0, 0, 0, TCPProtocol)
+	}
+	return pseudo
+}
+
+type testSegment struct {
+	ipv6    bool
+	id      uint16
+	seq     uint32
+	flags   uint8
+	payload []byte
+}
+
+/* Builds a TCP segment between fixed endpoints with correct checksums
+ */
+func (s testSegment) build() []byte {
+	var packet []byte
+	iphLen := 20
+	if s.ipv6 {
+		iphLen = 40
+		packet = make([]byte, iphLen+20+len(s.payload))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(20+len(s.payload)))
+		packet[6] = TCPProtocol
+		packet[7] = 64
+		copy(packet[8:], []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+		copy(packet[24:], []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2})
+	} else {
+		packet = make([]byte, iphLen+20+len(s.payload))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[4:], s.id)
+		packet[6] = 0x40 // don't fragment
+		packet[8] = 64
+		packet[9] = TCPProtocol
+		copy(packet[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+		binary.BigEndian.PutUint16(packet[10:], referenceChecksum(packet[:iphLen]))
+	}
+	tcp := packet[iphLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], s.seq)
+	binary.BigEndian.PutUint32(tcp[8:], 0x01020304)
+	tcp[12] = 5 << 4
+	tcp[13] = s.flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], s.payload)
+	binary.BigEndian.PutUint16(tcp[16:], referenceChecksum(referencePseudoHeader(packet, len(tcp)), tcp))
+	return packet
+}
+
+func testPayload(size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestChecksumHelpers(t *testing.T) {
+	// RFC 1071 section 3 example
+	data, _ := hex.DecodeString("0001f203f4f5f6f7")
+	if sum := checksumFold(checksumAdd(data, 0)); sum != 0xddf2 {
+		t.Errorf("RFC 1071 sum = %#04x, want 0xddf2", sum)
+	}
+	if sum := checksumFold(checksumAdd(data[:7], 0)); sum != ^referenceChecksum(data[:7]) {
+		t.Errorf("odd length sum = %#04x, want %#04x", sum, ^referenceChecksum(data[:7]))
+	}
+
+	// IPv4 header with a known checksum
+	header, _ := hex.DecodeString("450000730000400040110000c0a80001c0a800c7")
+	setIPv4Checksum(header, len(header))
+	if sum := binary.BigEndian.Uint16(header[IPv4offsetChecksum:]); sum != 0xb861 {
+		t.Errorf("IPv4 header checksum = %#04x, want 0xb861", sum)
+	}
+
+	for _, ipv6 := range []bool{false, true} {
+		packet := testSegment{ipv6: ipv6, seq: 1, flags: TCPFlagACK, payload: testPayload(101)}.build()
+		iphLen := len(packet) - 20 - 101
+		if !tcpChecksumValid(packet, iphLen) {
+			t.Errorf("ipv6=%v: valid segment rejected", ipv6)
+		}
+		pseudo := referencePseudoHeader(packet, len(packet)-iphLen)
+		if sum := checksumFold(pseudoHeaderSum(packet, TCPProtocol, len(packet)-iphLen)); sum != ^referenceChecksum(pseudo) {
+			t.Errorf("ipv6=%v: pseudo header sum = %#04x, want %#04x", ipv6, sum, ^referenceChecksum(pseudo))
+		}
+		packet[len(packet)-1] ^= 0x10
+		if tcpChecksumValid(packet, iphLen) {
+			t.Errorf("ipv6=%v: corrupted segment accepted", ipv6)
+		}
+	}
+}
+
+func TestVirtioNetHdr(t *testing.T) {
+	hdr := virtioNetHdr{
+		flags:      virtioNetHdrFlagNeedsCsum,
+		gsoType:    virtioNetHdrGSOTCPv6,
+		hdrLen:     60,
+		gsoSize:    1200,
+		csumStart:  40,
+		csumOffset: 16,
+	}
+	var b [VirtioNetHdrSize]byte
+	hdr.marshal(b[:])
+	if want := "01043c00b00428001000"; hex.EncodeToString(b[:]) != want {
+		t.Errorf("marshal = %x, want %s", b, want)
+	}
+	var decoded virtioNetHdr
+	if err := decoded.unmarshal(b[:]); err != nil || decoded != hdr {
+		t.Errorf("unmarshal = %+v, %v", decoded, err)
+	}
+	if err := decoded.unmarshal(b[:VirtioNetHdrSize-1]); err == nil {
+		t.Error("short header accepted")
+	}
+}
+
+/* Builds the super-packet the kernel hands over for segments,
+ * with the pseudo header sum in the checksum field
+ */
+func superPacket(first testSegment, payload []byte) []byte {
+	first.payload = payload
+	packet := first.build()
+	iphLen := len(packet) - 20 - len(payload)
+	pseudo := referencePseudoHeader(packet, len(packet)-iphLen)
+	binary.BigEndian.PutUint16(packet[iphLen+TCPOffsetChecksum:], ^referenceChecksum(pseudo))
+	return packet
+}
+
+func TestOffloadSegments(t *testing.T) {
+	payload := testPayload(3000)
+	needsCsum := superPacket(testSegment{id: 7, seq: 1000, flags: TCPFlagACK | TCPFlagPSH}, payload[:500])
+
+	for _, test := range []struct {
+		name     string
+		hdr      virtioNetHdr
+		packet   []byte
+		mtu      int
+		limit    int // segments accepted by next, 0 for all
+		want     [][]byte
+		tooBig   bool
+		errorful bool
+	}{
+		{
+			name:   "no offload",
+			packet: testSegment{id: 7, seq: 1000, flags: TCPFlagACK, payload: payload[:500]}.build(),
+			mtu:    1420,
+			want:   [][]byte{testSegment{id: 7, seq: 1000, flags: TCPFlagACK, payload: payload[:500]}.build()},
+		},
+		{
+			name:   "checksum completed",
+			hdr:    virtioNetHdr{flags: virtioNetHdrFlagNeedsCsum, csumStart: 20, csumOffset: TCPOffsetChecksum},
+			packet: needsCsum,
+			mtu:    1420,
+			want:   [][]byte{testSegment{id: 7, seq: 1000, flags: TCPFlagACK | TCPFlagPSH, payload: payload[:500]}.build()},
+		},
+		{
+			name:   "too big",
+			packet: testSegment{id: 7, seq: 1000, flags: TCPFlagACK, payload: payload[:1500]}.build(),
+			mtu:    1420,
+			tooBig: true,
+		},
+		{
+			name:   "TCPv4",
+			hdr:    virtioNetHdr{flags: virtioNetHdrFlagNeedsCsum, gsoType: virtioNetHdrGSOTCPv4, hdrLen: 40, gsoSize: 1000, csumStart: 20, csumOffset: TCPOffsetChecksum},
+			packet: superPacket(testSegment{id: 7, seq: 1000, flags: TCPFlagACK | TCPFlagPSH | TCPFlagFIN}, payload[:2500]),
+			mtu:    1420,
+			want: [][]byte{
+				testSegment{id: 7, seq: 1000, flags: TCPFlagACK, payload: payload[:1000]}.build(),
+				testSegment{id: 8, seq: 2000, flags: TCPFlagACK, payload: payload[1000:2000]}.build(),
+				testSegment{id: 9, seq: 3000, flags: TCPFlagACK | TCPFlagPSH | TCPFlagFIN, payload: payload[2000:2500]}.build(),
+			},
+		},
+		{
+			name:   "TCPv4 segments clamped to the MTU",
+			hdr:    virtioNetHdr{flags: virtioNetHdrFlagNeedsCsum, gsoType: virtioNetHdrGSOTCPv4, hdrLen: 40, gsoSize: 1400, csumStart: 20, csumOffset: TCPOffsetChecksum},
+			packet: superPacket(testSegment{id: 0xffff, seq: 0xfffffc00, flags: TCPFlagACK}, payload[:2000]),
+			mtu:    1040,
+			want: [][]byte{
+				testSegment{id: 0xffff, seq: 0xfffffc00, flags: TCPFlagACK, payload: payload[:1000]}.build(),
+				testSegment{id: 0, seq: 0xffffffe8, flags: TCPFlagACK, payload: payload[1000:2000]}.build(),
+			},
+		},
+		{
+			name:   "TCPv6",
+			hdr:    virtioNetHdr{flags: virtioNetHdrFlagNeedsCsum, gsoType: virtioNetHdrGSOTCPv6, hdrLen: 60, gsoSize: 1200, csumStart: 40, csumOffset: TCPOffsetChecksum},
+			packet: superPacket(testSegment{ipv6: true, seq: 5, flags: TCPFlagACK | TCPFlagPSH}, payload[:2500]),
+			mtu:    1420,
+			want: [][]byte{
+				testSegment{ipv6: true, seq: 5, flags: TCPFlagACK, payload: payload[:1200]}.build(),
+				testSegment{ipv6: true, seq: 1205, flags: TCPFlagACK, payload: payload[1200:2400]}.build(),
+				testSegment{ipv6: true, seq: 2405, flags: TCPFlagACK | TCPFlagPSH, payload: payload[2400:2500]}.build(),
+			},
+		},
+		{
+			name:   "next stops splitting",
+			hdr:    virtioNetHdr{flags: virtioNetHdrFlagNeedsCsum, gsoType: virtioNetHdrGSOTCPv4, hdrLen: 40, gsoSize: 1000, csumStart: 20, csumOffset: TCPOffsetChecksum},
+			packet: superPacket(testSegment{id: 7, seq: 1000, flags: TCPFlagACK}, payload[:2500]),
+			mtu:    1420,
+			limit:  1,
+			want:   [][]byte{testSegment{id: 7, seq: 1000, flags: TCPFlagACK, payload: payload[:1000]}.build()},
+		},
+		{
+			name:     "UDP GSO",
+			hdr:      virtioNetHdr{gsoType: 5, gsoSize: 1000, csumStart: 20},
+			packet:   superPacket(testSegment{seq: 1, flags: TCPFlagACK}, payload[:2500]),
+			mtu:      1420,
+			errorful: true,
+		},
+		{
+			name:     "TCPv4 type on IPv6",
+			hdr:      virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000, csumStart: 40},
+			packet:   superPacket(testSegment{ipv6: true, seq: 1, flags: TCPFlagACK}, payload[:2500]),
+			mtu:      1420,
+			errorful: true,
+		},
+		{
+			name:     "short",
+			hdr:      virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000, csumStart: 20},
+			packet:   superPacket(testSegment{seq: 1, flags: TCPFlagACK}, nil)[:30],
+			mtu:      1420,
+			errorful: true,
+		},
+		{
+			name:     "checksum offset out of range",
+			hdr:      virtioNetHdr{flags: virtioNetHdrFlagNeedsCsum, csumStart: 20, csumOffset: 2000},
+			packet:   superPacket(testSegment{seq: 1, flags: TCPFlagACK}, payload[:100]),
+			mtu:      1420,
+			errorful: true,
+		},
+	} {
+		var got [][]byte
+		tooBig := false
+		n, err := offloadSegments(&test.hdr, test.packet, test.mtu, func(size int) []byte {
+			if test.limit > 0 && len(got) >= test.limit {
+				return nil
+			}
+			got = append(got, make([]byte, size))
+			return got[len(got)-1]
+		}, func(packet []byte) {
+			tooBig = true
+		})
+		if test.errorful {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if tooBig != test.tooBig {
+			t.Errorf("%s: too big = %v", test.name, tooBig)
+		}
+		if n != len(test.want) || len(got) != len(test.want) {
+			t.Errorf("%s: %d segments, want %d", test.name, n, len(test.want))
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], test.want[i]) {
+				t.Errorf("%s: segment %d\n got %x\nwant %x", test.name, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+type testTUNWrites struct {
+	writes [][]byte
+}
+
+func (w *testTUNWrites) write(b []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+/* Splits the writes of a coalescer back into packets
+ */
+func (w *testTUNWrites) packets(t *testing.T) [][]byte {
+	var packets [][]byte
+	for _, b := range w.writes {
+		var hdr virtioNetHdr
+		if err := hdr.unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+		_, err := offloadSegments(&hdr, b[VirtioNetHdrSize:], OffloadMaxPacketSize, func(size int) []byte {
+			packets = append(packets, make([]byte, size))
+			return packets[len(packets)-1]
+		}, func(packet []byte) {
+			t.Fatal("write too big")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return packets
+}
+
+func TestTCPCoalescer(t *testing.T) {
+	payload := testPayload(6000)
+	segment := func(id uint16, seq uint32, flags uint8, size int) []byte {
+		return testSegment{id: id, seq: seq, flags: flags, payload: payload[seq%1000 : seq%1000+uint32(size)]}.build()
+	}
+	udp := testSegment{id: 1, seq: 0, flags: TCPFlagACK, payload: payload[:100]}.build()
+	udp[IPv4offsetProtocol] = UDPProtocol
+	corrupted := segment(3, 2000, TCPFlagACK, 1000)
+	corrupted[len(corrupted)-1] ^= 1
+	other := testSegment{ipv6: true, seq: 1000, flags: TCPFlagACK, payload: payload[:1000]}.build()
+
+	for _, test := range []struct {
+		name    string
+		packets [][]byte
+		single  int // index of the packet written with WriteSingle, -1 for none
+		writes  int
+	}{
+		{
+			name:    "consecutive",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), segment(2, 2000, TCPFlagACK, 1000), segment(3, 3000, TCPFlagACK|TCPFlagPSH, 1000)},
+			single:  -1,
+			writes:  1,
+		},
+		{
+			name:    "short segment ends the super-packet",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), segment(2, 2000, TCPFlagACK, 500), segment(3, 2500, TCPFlagACK, 500)},
+			single:  -1,
+			writes:  2,
+		},
+		{
+			name:    "PSH ends the super-packet",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK|TCPFlagPSH, 1000), segment(2, 2000, TCPFlagACK, 1000)},
+			single:  -1,
+			writes:  2,
+		},
+		{
+			name:    "sequence gap",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), segment(2, 3000, TCPFlagACK, 1000)},
+			single:  -1,
+			writes:  2,
+		},
+		{
+			name:    "FIN is not coalesced",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), segment(2, 2000, TCPFlagACK|TCPFlagFIN, 1000)},
+			single:  -1,
+			writes:  2,
+		},
+		{
+			name:    "bad checksum is not coalesced",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), corrupted},
+			single:  -1,
+			writes:  2,
+		},
+		{
+			name:    "other flow and protocol",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), other, udp, segment(2, 2000, TCPFlagACK, 1000)},
+			single:  -1,
+			writes:  4,
+		},
+		{
+			name:    "single write flushes first",
+			packets: [][]byte{segment(1, 1000, TCPFlagACK, 1000), segment(2, 2000, TCPFlagACK, 1000), udp},
+			single:  2,
+			writes:  2,
+		},
+	} {
+		w := &testTUNWrites{}
+		c := &tcpCoalescer{write: w.write}
+		for i, packet := range test.packets {
+			var err error
+			if i == test.single {
+				err = c.WriteSingle(append([]byte{}, packet...))
+			} else {
+				err = c.Add(append([]byte{}, packet...))
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if len(w.writes) != test.writes {
+			t.Errorf("%s: %d writes, want %d", test.name, len(w.writes), test.writes)
+		}
+		got := w.packets(t)
+		if len(got) != len(test.packets) {
+			t.Errorf("%s: %d packets written, want %d", test.name, len(got), len(test.packets))
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], test.packets[i]) {
+				t.Errorf("%s: packet %d\n got %x\nwant %x", test.name, i, got[i], test.packets[i])
+			}
+		}
+	}
+}
+
+func TestTCPCoalescerSuperPacket(t *testing.T) {
+	payload := testPayload(2000)
+	w := &testTUNWrites{}
+	c := &tcpCoalescer{write: w.write}
+	c.Add(testSegment{ipv6: true, seq: 1, flags: TCPFlagACK, payload: payload[:1000]}.build())
+	c.Add(testSegment{ipv6: true, seq: 1001, flags: TCPFlagACK | TCPFlagPSH, payload: payload[1000:]}.build())
+	c.Flush()
+
+	if len(w.writes) != 1 {
+		t.Fatalf("%d writes", len(w.writes))
+	}
+	want := superPacket(testSegment{ipv6: true, seq: 1, flags: TCPFlagACK | TCPFlagPSH}, payload)
+	var hdr virtioNetHdr
+	hdr.unmarshal(w.writes[0])
+	wantHdr := virtioNetHdr{
+		flags:      virtioNetHdrFlagNeedsCsum,
+		gsoType:    virtioNetHdrGSOTCPv6,
+		hdrLen:     60,
+		gsoSize:    1000,
+		csumStart:  40,
+		csumOffset: TCPOffsetChecksum,
+	}
+	if hdr != wantHdr {
+		t.Errorf("header %+v, want %+v", hdr, wantHdr)
+	}
+	if got := w.writes[0][VirtioNetHdrSize:]; !bytes.Equal(got, want) {
+		t.Errorf("super-packet\n got %x\nwant %x", got, want)
+	}
+}
@@ -13,6 +13,7 @@ type Peer struct {
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    *net.UDPAddr
+	transport                   Transport // set when the peer connected through the stream listener
 	time                        struct {
 		mutex         sync.RWMutex
 		lastSend      time.Time // last send message
@@ -45,11 +46,13 @@ type Peer struct {
 		sendLastMinuteHandshake bool
 	}
 	queue struct {
-		nonce    chan *QueueOutboundElement // nonce / pre-handshake queue
-		outbound chan *QueueOutboundElement // sequential ordering of work
-		inbound  chan *QueueInboundElement  // sequential ordering of work
+		nonce    [PriorityLaneCount]chan *QueueOutboundElement // nonce / pre-handshake queue per priority lane
+		outbound chan *QueueOutboundElement                    // sequential ordering of work
+		inbound  chan *QueueInboundElement                     // sequential ordering of work
 	}
-	mac CookieGenerator
+	mac            CookieGenerator
+	extensions     ExtensionState
+	innerAddresses []net.IPNet // addresses requested in the last initiation, guarded by mutex
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
@@ -79,7 +82,9 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	// prepare queuing
 
-	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
+	for lane := range peer.queue.nonce {
+		peer.queue.nonce[lane] = make(chan *QueueOutboundElement, QueueOutboundSize)
+	}
 	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
 	peer.queue.inbound = make(chan *QueueInboundElement, QueueInboundSize)
 
@@ -97,9 +102,9 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 func (peer *Peer) String() string {
 	str := "null"
-	conn := peer.device.net.conn
-	if conn != nil {
-		str = conn.LocalAddr().String()
+	transport := peer.device.net.transport
+	if transport != nil {
+		str = transport.LocalAddr().String()
 	}
 	return "peer(" + str + ")"
 }
@@ -114,7 +119,9 @@ func (peer *Peer) Close() {
 
 	//close queues
 	close(peer.signal.stop)
-	close(peer.queue.nonce)
+	for _, lane := range peer.queue.nonce {
+		close(lane)
+	}
 	close(peer.queue.outbound)
 	close(peer.queue.inbound)
 
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"bt/logger"
+)
+
+/* Path MTU discovery
+ *
+ * The prober sends keepalives padded to the size of the inner MTU
+ * (probes carry zero bytes instead of an IP packet and are discarded by the receiver).
+ * A non-empty transport message makes the remote send a passive keepalive,
+ * so a probe is considered lost if nothing is received within PMTUProbeTimeout.
+ *
+ * Probing only takes place while the tunnel is idle,
+ * otherwise unrelated inbound traffic would acknowledge lost probes.
+ */
+
+const (
+	MinMTU               = 1280
+	PMTUProbeInterval    = time.Second * 30
+	PMTUProbeTimeout     = KeepaliveTimeout + RekeyTimeout
+	PMTUStep             = 80
+	PMTUMaxProbeFailures = 3
+)
+
+type PathMTU struct {
+	lastReceived int64 // unix nano of the last authenticated packet, first for 64-bit alignment
+	enabled      AtomicBool
+	configured   int32 // mtu set by the configuration
+}
+
+func (pmtu *PathMTU) PacketReceived() {
+	atomic.StoreInt64(&pmtu.lastReceived, time.Now().UnixNano())
+}
+
+func (pmtu *PathMTU) receivedSince(t time.Time) bool {
+	return atomic.LoadInt64(&pmtu.lastReceived) > t.UnixNano()
+}
+
+/* Effective MTU of the tunnel
+ */
+func (device *Device) MTU() int {
+	return int(atomic.LoadInt32(&device.tun.mtu))
+}
+
+func (device *Device) setEffectiveMTU(mtu int) {
+	old := atomic.SwapInt32(&device.tun.mtu, int32(mtu))
+	if int(old) != mtu {
+		logger.Wlog.SaveInfoLog(fmt.Sprintf("effective MTU changed:%d -> %d", old, mtu))
+	}
+}
+
+/* Sets the configured MTU of the tunnel,
+ * the effective MTU is reset to the configured value
+ */
+func (device *Device) SetMTU(mtu int) error {
+	if mtu < MinMTU || mtu > MaxContentSize {
+		return errors.New("MTU out of range [" + strconv.Itoa(MinMTU) + "," + strconv.Itoa(MaxContentSize) + "]")
+	}
+	device.tun.device.SetMTU(mtu)
+	atomic.StoreInt32(&device.pmtu.configured, int32(mtu))
+	device.setEffectiveMTU(mtu)
+	return nil
+}
+
+/* Queues a keepalive padded to size bytes of content
+ */
+func (peer *Peer) SendProbe(size int) bool {
+	elem := peer.device.NewOutboundElement()
+	elem.probe = true
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+	setZero(elem.packet)
+	select {
+	case peer.queue.nonce[PriorityLaneControl] <- elem:
+		return true
+	default:
+		peer.device.PutMessageBuffer(elem.buffer)
+		return false
+	}
+}
+
+func (device *Device) RoutinePathMTUDiscovery() {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Wlog.SaveErrLog(fmt.Sprintln("recover RoutinePathMTUDiscovery err:", err))
+		}
+	}()
+
+	logger.Wlog.SaveDebugLog("Routine, path MTU discovery, started")
+
+	failures := 0
+	t := time.NewTicker(PMTUProbeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-device.signal.stop:
+			return
+		case <-t.C:
+		}
+
+		// may be turned on and off at runtime
+
+		if !device.pmtu.enabled.Get() {
+			failures = 0
+			continue
+		}
+
+		peer := device.LookupPeer()
+		if peer == nil || peer.keyPairs.Current() == nil {
+			continue
+		}
+
+		// only probe an idle tunnel
+
+		now := time.Now()
+		if device.pmtu.receivedSince(now.Add(-KeepaliveTimeout)) {
+			continue
+		}
+
+		// verify the current MTU, or try to grow back towards the configured one
+
+		effective := device.MTU()
+		configured := int(atomic.LoadInt32(&device.pmtu.configured))
+		size := effective
+		if failures == 0 && effective < configured {
+			size = effective + PMTUStep
+			if size > configured {
+				size = configured
+			}
+		}
+
+		if !peer.SendProbe(size) {
+			continue
+		}
+
+		select {
+		case <-device.signal.stop:
+			return
+		case <-time.After(PMTUProbeTimeout):
+		}
+
+		if device.pmtu.receivedSince(now) {
+			failures = 0
+			if size > effective {
+				device.setEffectiveMTU(size)
+			}
+			continue
+		}
+
+		if size > effective {
+			continue
+		}
+
+		failures++
+		if failures >= PMTUMaxProbeFailures && effective > MinMTU {
+			failures = 0
+			effective -= PMTUStep
+			if effective < MinMTU {
+				effective = MinMTU
+			}
+			device.setEffectiveMTU(effective)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Priority lanes of the outbound path
+ *
+ * Packets read from the TUN are classified and queued in one of the lanes
+ * of the nonce queue, the nonce routine always serves the highest non-empty lane.
+ * A full lane drops its own oldest element, so a bulk upload cannot push
+ * DNS queries, ICMP and TCP control segments out of the queue.
+ *
+ * Data packets are not classified by size, a flow spread over two lanes
+ * would be reordered. A flow takes the interactive lane until it sent
+ * PriorityBulkFlowBytes, as counted by the flow tracker, then the bulk lane
+ * until it goes idle and expires. Moving to a lower lane keeps the order,
+ * the packets already queued in the higher lane are served first.
+ * Only TCP segments without data (SYN, FIN, RST, pure ACK) take the control lane.
+ * Once past the nonce routine, packets are no longer dropped but wait
+ * for room in the encryption and sequential queues.
+ */
+
+const (
+	PriorityLaneControl     = iota // DNS, ICMP, TCP segments without data, keepalives
+	PriorityLaneInteractive        // flows which sent less than PriorityBulkFlowBytes
+	PriorityLaneBulk               // flows which sent more
+	PriorityLaneCount
+)
+
+const (
+	PriorityBulkFlowBytes = 1 << 20
+	ICMPProtocol          = 1
+	ICMPv6Protocol        = 58
+	TCPFlagRST            = 0x04
+)
+
+var priorityLaneNames = [PriorityLaneCount]string{
+	"control",
+	"interactive",
+	"bulk",
+}
+
+/* Returns the lane of an IP packet,
+ * sent is the number of bytes its flow sent so far
+ */
+func classifyPacket(packet []byte, sent uint64) int {
+	if len(packet) == 0 {
+		return PriorityLaneControl
+	}
+
+	var protocol byte
+	var transport []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return PriorityLaneBulk
+		}
+		protocol = packet[IPv4offsetProtocol]
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl >= ipv4.HeaderLen && ihl <= len(packet) &&
+			binary.BigEndian.Uint16(packet[IPv4offsetFragment:])&0x1fff == 0 {
+			transport = packet[ihl:]
+		}
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return PriorityLaneBulk
+		}
+		protocol = packet[IPv6offsetNextHeader]
+		transport = packet[ipv6.HeaderLen:]
+	default:
+		return PriorityLaneBulk
+	}
+
+	switch protocol {
+	case ICMPProtocol, ICMPv6Protocol:
+		return PriorityLaneControl
+	case UDPProtocol:
+		if len(transport) >= 4 &&
+			(binary.BigEndian.Uint16(transport[0:2]) == DNSPort || binary.BigEndian.Uint16(transport[2:4]) == DNSPort) {
+			return PriorityLaneControl
+		}
+	case TCPProtocol:
+		if len(transport) >= TCPHeaderLen {
+			dataOffset := int(transport[TCPOffsetDataOffset]>>4) * 4
+			if dataOffset >= len(transport) {
+				return PriorityLaneControl // no data
+			}
+		}
+	}
+
+	if sent > PriorityBulkFlowBytes {
+		return PriorityLaneBulk
+	}
+	return PriorityLaneInteractive
+}
+
+/* Queues an element in a lane of the nonce queue,
+ * dropping the oldest element of the lane when it is full
+ */
+func (device *Device) addToNonceQueue(peer *Peer, lane int, element *QueueOutboundElement) {
+	queue := peer.queue.nonce[lane]
+	for {
+		select {
+		case queue <- element:
+			return
+		default:
+			select {
+			case old := <-queue:
+				device.PutMessageBuffer(old.buffer)
+				device.counters.LaneDropped(lane)
+			default:
+			}
+		}
+	}
+}
+
+/* Takes the next element of the highest non-empty lane,
+ * blocks until there is one or the peer is stopped
+ */
+func (peer *Peer) nextNonceElement() (*QueueOutboundElement, bool) {
+	lanes := &peer.queue.nonce
+	for lane := range lanes {
+		select {
+		case elem, ok := <-lanes[lane]:
+			return elem, ok
+		default:
+		}
+	}
+
+	select {
+	case <-peer.signal.stop:
+		return nil, false
+	case elem, ok := <-lanes[PriorityLaneControl]:
+		return elem, ok
+	case elem, ok := <-lanes[PriorityLaneInteractive]:
+		return elem, ok
+	case elem, ok := <-lanes[PriorityLaneBulk]:
+		return elem, ok
+	}
+}
+
+func (peer *Peer) nonceQueueLen() int {
+	size := 0
+	for _, lane := range peer.queue.nonce {
+		size += len(lane)
+	}
+	return size
+}
+
+func (c *Counters) LaneDropped(lane int) {
+	atomic.AddUint64(&c.laneDrops[lane], 1)
+	atomic.AddUint64(&c.queueDrops[QueueDropOutbound], 1)
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestClassifyPacket(t *testing.T) {
+	payload := testPayload(1200)
+	udp := func(port uint16, size int) []byte {
+		packet := testSegment{seq: 1, payload: payload[:size]}.build()
+		packet[IPv4offsetProtocol] = UDPProtocol
+		binary.BigEndian.PutUint16(packet[20+2:], port)
+		return packet
+	}
+	icmp := testSegment{seq: 1, payload: payload[:1000]}.build()
+	icmp[IPv4offsetProtocol] = ICMPProtocol
+
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		lane   int
+	}{
+		{"empty", nil, PriorityLaneControl},
+		{"ICMP", icmp, PriorityLaneControl},
+		{"DNS", udp(DNSPort, 1000), PriorityLaneControl},
+		{"small UDP", udp(443, 100), PriorityLaneInteractive},
+		{"large UDP", udp(443, 1000), PriorityLaneInteractive},
+		{"TCP data", testSegment{flags: TCPFlagACK, payload: payload}.build(), PriorityLaneInteractive},
+		{"SYN", testSegment{flags: TCPFlagSYN}.build(), PriorityLaneControl},
+		{"pure ACK", testSegment{flags: TCPFlagACK}.build(), PriorityLaneControl},
+		{"FIN", testSegment{flags: TCPFlagACK | TCPFlagFIN}.build(), PriorityLaneControl},
+		{"RST", testSegment{flags: TCPFlagRST}.build(), PriorityLaneControl},
+		{"IPv6 pure ACK", testSegment{ipv6: true, flags: TCPFlagACK}.build(), PriorityLaneControl},
+	} {
+		if lane := classifyPacket(test.packet, 0); lane != test.lane {
+			t.Errorf("%s: lane %s, want %s", test.name, priorityLaneNames[lane], priorityLaneNames[test.lane])
+		}
+	}
+}
+
+/* A flow takes the interactive lane whatever the size of its packets,
+ * and the bulk lane once it sent PriorityBulkFlowBytes
+ */
+func TestClassifyFlowVolume(t *testing.T) {
+	payload := testPayload(1200)
+	var ft FlowTracker // disabled, outbound packets still count
+
+	for _, protocol := range []byte{TCPProtocol, UDPProtocol} {
+		for _, ipv6 := range []bool{false, true} {
+			flow := func(port uint16, size int) []byte {
+				packet := testSegment{ipv6: ipv6, flags: TCPFlagACK, payload: payload[:size]}.build()
+				header := len(packet) - size - 20
+				binary.BigEndian.PutUint16(packet[header:], port)
+				if protocol == UDPProtocol {
+					if ipv6 {
+						packet[IPv6offsetNextHeader] = UDPProtocol
+					} else {
+						packet[IPv4offsetProtocol] = UDPProtocol
+					}
+				}
+				return packet
+			}
+
+			var sent int
+			for i := 0; sent <= PriorityBulkFlowBytes; i++ {
+				packet := flow(40000, []int{1, 100, 1200}[i%3])
+				sent += len(packet)
+				lane := classifyPacket(packet, ft.Track(packet, true))
+				if want := PriorityLaneInteractive; sent > PriorityBulkFlowBytes {
+					want = PriorityLaneBulk
+					if lane != want {
+						t.Fatalf("protocol %d ipv6=%v: lane %s after %d bytes, want bulk", protocol, ipv6, priorityLaneNames[lane], sent)
+					}
+				} else if lane != want {
+					t.Fatalf("protocol %d ipv6=%v: lane %s after %d bytes, want interactive", protocol, ipv6, priorityLaneNames[lane], sent)
+				}
+			}
+
+			// small packets of the bulk flow stay in its lane, other flows are not affected
+			packet := flow(40000, 1)
+			if lane := classifyPacket(packet, ft.Track(packet, true)); lane != PriorityLaneBulk {
+				t.Errorf("protocol %d ipv6=%v: small packet of a bulk flow in lane %s", protocol, ipv6, priorityLaneNames[lane])
+			}
+			packet = flow(40001, 1200)
+			if lane := classifyPacket(packet, ft.Track(packet, true)); lane != PriorityLaneInteractive {
+				t.Errorf("protocol %d ipv6=%v: new flow in lane %s", protocol, ipv6, priorityLaneNames[lane])
+			}
+		}
+	}
+	if n := ft.Len(); n != 0 {
+		t.Errorf("%d flows reported with tracking disabled", n)
+	}
+}
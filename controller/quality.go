@@ -0,0 +1,277 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"bt/logger"
+)
+
+/* Connection quality estimation
+ *
+ * RTT is sampled from handshake initiation -> response and passively from
+ * the first data packet sent after an inbound idle period to the next packet
+ * received, usually its answer (a DNS query, a TCP SYN or request). Keepalives
+ * are not echoed by the gateway and take no sample; passive samples longer
+ * than twice the retransmission timeout of RFC 6298 belong to unrelated
+ * traffic and are discarded. Samples are smoothed as in RFC 6298.
+ *
+ * Inbound loss and reordering are estimated from the transport counters
+ * accepted by the replay filter: for a key-pair the sender numbers packets
+ * from 0, so highest+1 packets are expected once "highest" has been seen.
+ */
+
+const (
+	QualityReportInterval = time.Second * 5
+	QualityMaxRTTSample   = RekeyTimeout
+	QualityIdleInterval   = time.Second // inbound silence before a passive sample
+)
+
+type Quality struct {
+	mutex sync.Mutex
+
+	// rtt
+
+	srtt          time.Duration
+	rttvar        time.Duration
+	rttSamples    uint64
+	handshakeRTT  time.Duration
+	handshakeSent time.Time
+	dataSent      time.Time // pending passive sample
+	lastPacket    time.Time
+
+	// loss & reordering (current key-pair)
+
+	keyPair  *KeyPair
+	highest  uint64
+	received uint64
+
+	// loss & reordering (totals)
+
+	expectedTotal  uint64
+	receivedTotal  uint64
+	reorderedTotal uint64
+
+	// loss over the last report intervals
+
+	lastExpected uint64
+	lastReceived uint64
+	lossPercent  float64
+}
+
+type QualitySnapshot struct {
+	SmoothedRTT  float64 `json:"srtt_ms"`
+	Jitter       float64 `json:"jitter_ms"`
+	HandshakeRTT float64 `json:"handshake_rtt_ms"`
+	RTTSamples   uint64  `json:"rtt_samples"`
+	LossPercent  float64 `json:"loss_percent"`
+	Expected     uint64  `json:"expected"`
+	Received     uint64  `json:"received"`
+	Reordered    uint64  `json:"reordered"`
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+/* Caller must hold the quality mutex
+ */
+func (q *Quality) addRTTSample(sample time.Duration) {
+	if q.rttSamples == 0 {
+		q.srtt = sample
+		q.rttvar = sample / 2
+	} else {
+		delta := q.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		q.rttvar = (3*q.rttvar + delta) / 4
+		q.srtt = (7*q.srtt + sample) / 8
+	}
+	q.rttSamples++
+}
+
+func (q *Quality) HandshakeSent() {
+	q.mutex.Lock()
+	q.handshakeSent = time.Now()
+	q.mutex.Unlock()
+}
+
+func (q *Quality) HandshakeCompleted() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.handshakeSent.IsZero() {
+		return
+	}
+	sample := time.Now().Sub(q.handshakeSent)
+	q.handshakeSent = time.Time{}
+	if sample > QualityMaxRTTSample {
+		return
+	}
+	q.handshakeRTT = sample
+	q.addRTTSample(sample)
+}
+
+/* Called by the sequential sender once per batch containing data,
+ * starts a passive sample if nothing was received for a while
+ */
+func (q *Quality) DataSent() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	if !q.dataSent.IsZero() && now.Sub(q.dataSent) <= QualityMaxRTTSample {
+		return
+	}
+	if now.Sub(q.lastPacket) < QualityIdleInterval {
+		return
+	}
+	q.dataSent = now
+}
+
+/* Caller must hold the quality mutex
+ */
+func (q *Quality) packetReceived(now time.Time) {
+	q.lastPacket = now
+	if q.dataSent.IsZero() {
+		return
+	}
+	sample := now.Sub(q.dataSent)
+	q.dataSent = time.Time{}
+	if sample > QualityMaxRTTSample {
+		return
+	}
+	if q.rttSamples > 0 && sample > 2*(q.srtt+4*q.rttvar) {
+		return
+	}
+	q.addRTTSample(sample)
+}
+
+/* Called by the sequential receiver for every counter
+ * accepted by the replay filter of the key-pair,
+ * keepalives included
+ */
+func (q *Quality) CounterReceived(keyPair *KeyPair, counter uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.packetReceived(time.Now())
+
+	if keyPair != q.keyPair {
+
+		// ignore stragglers from the previous key-pair
+
+		if q.keyPair != nil && keyPair.created.Before(q.keyPair.created) {
+			return
+		}
+		if q.keyPair != nil {
+			q.expectedTotal += q.highest + 1
+			q.receivedTotal += q.received
+		}
+		q.keyPair = keyPair
+		q.highest = counter
+		q.received = 1
+		return
+	}
+
+	if counter > q.highest {
+		q.highest = counter
+	} else {
+		q.reorderedTotal++
+	}
+	q.received++
+}
+
+/* Caller must hold the quality mutex
+ */
+func (q *Quality) totals() (uint64, uint64) {
+	expected := q.expectedTotal
+	received := q.receivedTotal
+	if q.keyPair != nil {
+		expected += q.highest + 1
+		received += q.received
+	}
+	return expected, received
+}
+
+/* Folds the loss of the last interval into the smoothed loss percentage
+ */
+func (q *Quality) updateLoss() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	expected, received := q.totals()
+	if expected < q.lastExpected || received < q.lastReceived {
+		q.lastExpected = expected
+		q.lastReceived = received
+		return
+	}
+	dExpected := expected - q.lastExpected
+	dReceived := received - q.lastReceived
+	q.lastExpected = expected
+	q.lastReceived = received
+	if dExpected == 0 {
+		return
+	}
+
+	loss := 0.0
+	if dReceived < dExpected {
+		loss = float64(dExpected-dReceived) * 100 / float64(dExpected)
+	}
+	q.lossPercent = (3*q.lossPercent + loss) / 4
+}
+
+func (q *Quality) Snapshot() QualitySnapshot {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	expected, received := q.totals()
+	return QualitySnapshot{
+		SmoothedRTT:  durationToMs(q.srtt),
+		Jitter:       durationToMs(q.rttvar),
+		HandshakeRTT: durationToMs(q.handshakeRTT),
+		RTTSamples:   q.rttSamples,
+		LossPercent:  q.lossPercent,
+		Expected:     expected,
+		Received:     received,
+		Reordered:    q.reorderedTotal,
+	}
+}
+
+func sendQuality(s string) {
+	select {
+	case QualityChan <- s:
+	default:
+	}
+}
+
+/* Periodically updates the loss estimate and reports
+ * the connection quality to the app
+ */
+func (device *Device) RoutineQualityReporter() {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Wlog.SaveErrLog(fmt.Sprintln("recover RoutineQualityReporter err:", err))
+		}
+	}()
+
+	t := time.NewTicker(QualityReportInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-device.signal.stop:
+			return
+		case <-t.C:
+			device.quality.updateLoss()
+			b, err := json.Marshal(device.quality.Snapshot())
+			if err != nil {
+				continue
+			}
+			sendQuality(string(b))
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQualityPassiveRTT(t *testing.T) {
+	var q Quality
+	keyPair := newTestKeyPair()
+
+	// idle since start, the first data packet takes a sample
+	q.DataSent()
+	time.Sleep(10 * time.Millisecond)
+	q.CounterReceived(keyPair, 0)
+	if q.rttSamples != 1 || q.srtt < 10*time.Millisecond || q.srtt > QualityMaxRTTSample {
+		t.Fatalf("%d samples, srtt %v", q.rttSamples, q.srtt)
+	}
+
+	// traffic flowing, no sample
+	q.DataSent()
+	q.CounterReceived(keyPair, 1)
+	if q.rttSamples != 1 {
+		t.Errorf("sampled %d times while receiving", q.rttSamples)
+	}
+
+	// an answer far later than the timeout is unrelated traffic
+	q.lastPacket = time.Now().Add(-time.Minute)
+	q.DataSent()
+	q.dataSent = q.dataSent.Add(-time.Second)
+	q.CounterReceived(keyPair, 2)
+	if q.rttSamples != 1 {
+		t.Errorf("outlier sampled, srtt %v", q.srtt)
+	}
+
+	// a pending sample never answered is replaced
+	q.lastPacket = time.Now().Add(-time.Minute)
+	q.dataSent = time.Now().Add(-time.Minute)
+	q.DataSent()
+	q.CounterReceived(keyPair, 3)
+	if q.rttSamples != 2 {
+		t.Errorf("stale pending sample kept, %d samples", q.rttSamples)
+	}
+}
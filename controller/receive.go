@@ -19,10 +19,11 @@ import (
 )
 
 type QueueHandshakeElement struct {
-	msgType uint32
-	packet  []byte
-	buffer  *[MaxMessageSize]byte
-	source  *net.UDPAddr
+	msgType   uint32
+	packet    []byte
+	buffer    *[MaxMessageSize]byte
+	source    *net.UDPAddr
+	transport Transport // transport the message arrived on
 }
 
 type QueueInboundElement struct {
@@ -53,7 +54,10 @@ func (device *Device) addToInboundQueue(
 		default:
 			select {
 			case old := <-queue:
+				// a worker may still hold the buffer
 				old.Drop()
+				device.releaseMessageBuffer()
+				device.counters.QueueDropped(QueueDropInbound)
 			default:
 			}
 		}
@@ -74,6 +78,7 @@ func (device *Device) addToDecryptionQueue(
 				// drop & release to potential consumer
 				old.Drop()
 				old.mutex.Unlock()
+				device.counters.QueueDropped(QueueDropDecryption)
 			default:
 			}
 		}
@@ -92,6 +97,7 @@ func (device *Device) addToHandshakeQueue(
 			select {
 			case elem := <-queue:
 				device.PutMessageBuffer(elem.buffer)
+				device.counters.QueueDropped(QueueDropHandshake)
 			default:
 			}
 		}
@@ -117,115 +123,192 @@ func (device *Device) RoutineReceiveIncomming() {
 		case <-device.signal.newUDPConn:
 			// fetch connection
 			device.net.mutex.RLock()
-			conn := device.net.conn
+			transport := device.net.transport
 			device.net.mutex.RUnlock()
-			if conn == nil {
+			if transport == nil {
 				continue
 			}
 
 			logger.Wlog.SaveDebugLog("Listening for inbound packets")
 			// receive datagrams until conn is closed
 
-			go device.handleUDP(conn)
+			go device.handleTransport(transport)
 		}
 	}
 }
 
-func (device *Device) handleUDP(conn *net.UDPConn) {
+func (device *Device) handleTransport(transport Transport) {
+	if batch, ok := transport.(BatchTransport); ok {
+		device.handleBatchTransport(batch)
+		return
+	}
+
 	buffer := device.GetMessageBuffer()
+	defer func() {
+		device.PutMessageBuffer(buffer)
+	}()
 
 	for {
-		size, raddr, err := conn.ReadFromUDP(buffer[:])
+		size, raddr, err := transport.Receive(buffer[:])
 		if err != nil {
-			if strings.Contains(err.Error(), "message too long") {
-				logger.Wlog.SaveErrLog("读取UDP失败:" + err.Error())
-				continue
-			} else {
-				logger.Wlog.SaveErrLog("UDP退出:" + err.Error())
+			if device.receiveFailed(transport, err) {
 				return
 			}
-		}
-
-		logger.Wlog.SaveErrLog(fmt.Sprintln("收到 UDP 数据:", size, err))
-		if size < MinMessageSize {
 			continue
 		}
+		if device.handleMessage(transport, buffer, size, raddr) {
+			buffer = device.GetMessageBuffer()
+		}
+	}
+}
 
-		//DownloadFlowNum += size
-		// check size of packet
-		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
-
-		IntervalStartTime = time.Now().Unix()
-		if !firstConnSuccess {
-			go sendStatus(1)
-			firstConnSuccess = true
+/* Receives messages in batches,
+ * buffers handed to a queue are replaced before the next batch
+ * and the remaining ones returned when the transport is gone
+ */
+func (device *Device) handleBatchTransport(transport BatchTransport) {
+	buffers := make([]*[MaxMessageSize]byte, UDPBatchSize)
+	packets := make([][]byte, UDPBatchSize)
+	sizes := make([]int, UDPBatchSize)
+	addrs := make([]*net.UDPAddr, UDPBatchSize)
+	for i := range buffers {
+		buffers[i] = device.GetMessageBuffer()
+		packets[i] = buffers[i][:]
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			device.PutMessageBuffer(buffer)
 		}
+	}()
 
-		var okay bool
-		switch msgType {
-		// check if transport
-		case MessageTransportType:
-			// check size
-			if len(packet) < MessageTransportType {
-				continue
+	for {
+		n, err := transport.ReceiveBatch(packets, sizes, addrs)
+		if err != nil {
+			if device.receiveFailed(transport, err) {
+				return
 			}
-
-			// lookup key pair
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indices.Lookup(receiver)
-			keyPair := value.keyPair
-			if keyPair == nil {
-				continue
+			continue
+		}
+		for i := 0; i < n; i++ {
+			if device.handleMessage(transport, buffers[i], sizes[i], addrs[i]) {
+				buffers[i] = device.GetMessageBuffer()
+				packets[i] = buffers[i][:]
 			}
+		}
+	}
+}
 
-			// check key-pair expiry
-			if keyPair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+/* Returns true when the transport is gone
+ */
+func (device *Device) receiveFailed(transport Transport, err error) bool {
+	if strings.Contains(err.Error(), "message too long") && transport.Name() == TransportUDP {
+		logger.Wlog.SaveErrLog("读取UDP失败:" + err.Error())
+		return false
+	}
+	logger.Wlog.SaveErrLog(transport.Name() + "退出:" + err.Error())
+	device.transportClosed(transport)
+	return true
+}
 
-			// create work element
-			peer := value.peer
-			elem := &QueueInboundElement{
-				packet:  packet,
-				buffer:  buffer,
-				keyPair: keyPair,
-				dropped: AtomicFalse,
-			}
-			elem.mutex.Lock()
+/* Queues a received message for decryption or the handshake routine,
+ * returns true when the buffer was handed to a queue
+ */
+func (device *Device) handleMessage(transport Transport, buffer *[MaxMessageSize]byte, size int, raddr *net.UDPAddr) bool {
+	logger.Wlog.SaveErrLog(fmt.Sprintln("收到 UDP 数据:", size))
+	device.counters.Received(size)
+	if size < MinMessageSize {
+		return false
+	}
 
-			// add to decryption queues
-			device.addToDecryptionQueue(device.queue.decryption, elem)
-			device.addToInboundQueue(peer.queue.inbound, elem)
-			buffer = device.GetMessageBuffer()
-			continue
+	//DownloadFlowNum += size
+	// check size of packet
+	packet := buffer[:size]
+	if obfuscator := device.obfuscation.Get(); obfuscator != nil {
+		packet = obfuscator.Deobfuscate(packet)
+		if len(packet) < MinMessageSize {
+			return false
+		}
+	}
+	msgType := binary.LittleEndian.Uint32(packet[:4])
 
-			// otherwise it is a handshake related packet
+	IntervalStartTime = time.Now().Unix()
+	if !firstConnSuccess {
+		go sendStatus(1)
+		firstConnSuccess = true
+	}
 
-		case MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
-		case MessageResponseType:
-			okay = len(packet) == MessageResponseSize
-		case MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+	var okay bool
+	switch msgType {
+	// check if transport
+	case MessageTransportType:
+		// check size
+		if len(packet) < MessageTransportType {
+			return false
 		}
 
-		if okay {
-			device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType: msgType,
-					buffer:  buffer,
-					packet:  packet,
-					source:  raddr,
-				},
-			)
+		// lookup key pair
+		receiver := binary.LittleEndian.Uint32(
+			packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+		)
+		value := device.indices.Lookup(receiver)
+		keyPair := value.keyPair
+		if keyPair == nil {
+			return false
+		}
 
-			buffer = device.GetMessageBuffer()
+		// check key-pair expiry
+		if keyPair.created.Add(RejectAfterTime).Before(time.Now()) {
+			return false
+		}
+
+		if device.overBudget() {
+			return false
 		}
+
+		// create work element
+		peer := value.peer
+		elem := &QueueInboundElement{
+			packet:  packet,
+			buffer:  buffer,
+			keyPair: keyPair,
+			dropped: AtomicFalse,
+		}
+		elem.mutex.Lock()
+
+		// add to decryption queues
+		device.addToDecryptionQueue(device.queue.decryption, elem)
+		device.addToInboundQueue(peer.queue.inbound, elem)
+		return true
+
+		// otherwise it is a handshake related packet
+
+	case MessageInitiationType:
+		okay = len(packet) == MessageInitiationV0Size || len(packet) == MessageInitiationV1Size
+	case MessageInitiationExtendedType:
+		okay = len(packet) >= MessageInitiationMinSize && len(packet) <= MessageInitiationMaxSize
+	case MessageResponseType:
+		okay = len(packet) == MessageResponseSize
+	case MessageResponseExtendedType:
+		okay = len(packet) >= MessageResponseExtendedMinSize && len(packet) <= MessageResponseExtendedMaxSize
+	case MessageCookieReplyType:
+		okay = len(packet) == MessageCookieReplySize
 	}
+
+	if okay {
+		device.addToHandshakeQueue(
+			device.queue.handshake,
+			QueueHandshakeElement{
+				msgType:   msgType,
+				buffer:    buffer,
+				packet:    packet,
+				source:    raddr,
+				transport: transport,
+			},
+		)
+
+		return true
+	}
+	return false
 }
 
 func (device *Device) RoutineDecryption() {
@@ -259,7 +342,7 @@ func (device *Device) RoutineDecryption() {
 			copy(nonce[4:], counter)
 			elem.counter = binary.LittleEndian.Uint64(counter)
 			elem.packet, err = elem.keyPair.receive.Open(
-				elem.buffer[:0],
+				content[:0],
 				nonce[:],
 				content,
 				nil,
@@ -286,6 +369,12 @@ func (device *Device) RoutineHandshake() {
 	var elem QueueHandshakeElement
 
 	for {
+		// return the buffer of the previous message
+		if elem.buffer != nil {
+			device.PutMessageBuffer(elem.buffer)
+			elem.buffer = nil
+		}
+
 		select {
 		case elem = <-device.queue.handshake:
 		case <-device.signal.stop:
@@ -313,11 +402,13 @@ func (device *Device) RoutineHandshake() {
 				return
 			}
 			entry.peer.mac.ConsumeReply(&reply)
+			device.counters.inc(&device.counters.cookieReplyReceived)
 			continue
-		case MessageInitiationType, MessageResponseType:
+		case MessageInitiationType, MessageResponseType, MessageInitiationExtendedType, MessageResponseExtendedType:
 
 			// check mac fields and ratelimit
 			if !device.mac.CheckMAC1(elem.packet) {
+				device.counters.HandshakeFailed(HandshakeFailureInvalidMAC1)
 				logger.Wlog.SaveDebugLog("Received packet with invalid mac1")
 				return
 			}
@@ -337,8 +428,12 @@ func (device *Device) RoutineHandshake() {
 					// marshal and send reply
 					writer := bytes.NewBuffer(temp[:0])
 					binary.Write(writer, binary.LittleEndian, reply)
-					_, err = device.net.conn.WriteToUDP(
-						writer.Bytes(),
+					packet := writer.Bytes()
+					if obfuscator := device.obfuscation.Get(); obfuscator != nil {
+						packet = obfuscator.Obfuscate(packet)
+					}
+					_, err = elem.transport.SendTo(
+						packet,
 						elem.source,
 					)
 					if err != nil {
@@ -346,11 +441,14 @@ func (device *Device) RoutineHandshake() {
 						changeNetwork(device, Endpoint)
 
 						logger.Wlog.SaveDebugLog("Failed to send cookie reply:" + err.Error())
+					} else {
+						device.counters.inc(&device.counters.cookieReplySent)
 					}
 					continue
 				}
 
 				if !device.ratelimiter.Allow(elem.source.IP) {
+					device.counters.HandshakeFailed(HandshakeFailureRatelimit)
 					continue
 				}
 			}
@@ -362,19 +460,21 @@ func (device *Device) RoutineHandshake() {
 
 		// handle handshake initation/response content
 		switch elem.msgType {
-		case MessageInitiationType:
+		case MessageInitiationType, MessageInitiationExtendedType:
 			// unmarshal
 			var msg MessageInitiation
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
+			err := msg.unmarshal(elem.packet)
 			if err != nil {
+				device.counters.HandshakeFailed(HandshakeFailureDecode)
 				logger.Wlog.SaveErrLog("Failed to decode initiation message")
 				continue
 			}
+			device.counters.inc(&device.counters.handshakeInitiationReceived)
 
 			// consume initiation
 			peer := device.ConsumeMessageInitiation(&msg)
 			if peer == nil {
+				device.counters.HandshakeFailed(HandshakeFailureInvalidInitiation)
 				logger.Wlog.SaveInfoLog("Recieved invalid initiation message from:" + elem.source.IP.String() + strconv.Itoa(elem.source.Port))
 				continue
 			}
@@ -387,11 +487,25 @@ func (device *Device) RoutineHandshake() {
 			// TODO: Discover destination address also, only update on change
 			peer.mutex.Lock()
 			peer.endpoint = elem.source
+			peer.transport = nil
+			if elem.transport != device.primaryTransport() {
+				peer.transport = elem.transport
+			}
 			peer.mutex.Unlock()
 
+			// route the inner addresses requested by the initiator
+
+			device.assignInnerAddresses(peer, &msg)
+
 			// create response
-			response, err := device.CreateMessageResponse(peer)
+			var extensions *ExtensionBlock
+			if msg.Type == MessageInitiationExtendedType {
+				negotiated := peer.extensions.Negotiate(&msg.Extensions)
+				extensions = &negotiated
+			}
+			response, err := device.CreateMessageResponse(peer, extensions)
 			if err != nil {
+				device.counters.HandshakeFailed(HandshakeFailureCreate)
 				logger.Wlog.SaveErrLog("Failed to create response message:" + err.Error())
 				continue
 			}
@@ -402,31 +516,35 @@ func (device *Device) RoutineHandshake() {
 			logger.Wlog.SaveDebugLog("Creating response message for: " + peer.String())
 
 			writer := bytes.NewBuffer(temp[:0])
-			binary.Write(writer, binary.LittleEndian, response)
+			response.marshal(writer)
 			packet := writer.Bytes()
 			peer.mac.AddMacs(packet)
 
 			// send response
 			_, err = peer.SendBuffer(packet)
 			if err == nil {
+				device.counters.inc(&device.counters.handshakeResponseSent)
 				peer.TimerAnyAuthenticatedPacketTraversal()
 			} else {
+				device.counters.HandshakeFailed(HandshakeFailureSend)
 				logger.Wlog.SaveInfoLog("RoutineHandshake发送失败")
 			}
 
-		case MessageResponseType:
+		case MessageResponseType, MessageResponseExtendedType:
 			// unmarshal
 			var msg MessageResponse
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
+			err := msg.unmarshal(elem.packet)
 			if err != nil {
+				device.counters.HandshakeFailed(HandshakeFailureDecode)
 				logger.Wlog.SaveErrLog("Failed to decode response message")
 				continue
 			}
+			device.counters.inc(&device.counters.handshakeResponseReceived)
 
 			// consume response
 			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
+				device.counters.HandshakeFailed(HandshakeFailureInvalidResponse)
 				logger.Wlog.SaveInfoLog("Recieved invalid response message from " + elem.source.IP.String() + strconv.Itoa(elem.source.Port))
 				continue
 			}
@@ -436,6 +554,12 @@ func (device *Device) RoutineHandshake() {
 			}
 			initiationNum++
 
+			if msg.Type == MessageResponseExtendedType {
+				peer.extensions.Negotiated(&msg.Extensions)
+			}
+
+			device.quality.HandshakeCompleted()
+			device.transportSucceeded()
 			peer.TimerEphemeralKeyCreated()
 
 			// update timers
@@ -458,7 +582,20 @@ func (peer *Peer) RoutineSequentialReceiver() {
 	}()
 
 	device := peer.device
+	var done *QueueInboundElement
 	for {
+		// return the buffer of the previous element
+		if done != nil {
+			device.PutMessageBuffer(done.buffer)
+			done = nil
+		}
+
+		// write coalesced segments before waiting
+		if len(peer.queue.inbound) == 0 {
+			if err := device.tun.device.Flush(); err != nil {
+				logger.Wlog.SaveErrLog("Failed to write packet to TUN device:" + err.Error())
+			}
+		}
 
 		select {
 		case <-peer.signal.stop:
@@ -466,6 +603,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		case elem := <-peer.queue.inbound:
 			// wait for decryption
 			elem.mutex.Lock()
+			done = elem
 			if elem.IsDropped() {
 				continue
 			}
@@ -474,10 +612,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			if !elem.keyPair.replayFilter.ValidateCounter(elem.counter) {
 				continue
 			}
+			device.quality.CounterReceived(elem.keyPair, elem.counter)
 
 			peer.TimerAnyAuthenticatedPacketTraversal()
 			peer.TimerAnyAuthenticatedPacketReceived()
 			peer.KeepKeyFreshReceiving()
+			device.pmtu.PacketReceived()
 
 			// check if using new key-pair
 
@@ -505,6 +645,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			}
 			peer.TimerDataReceived()
 
+			// discard path MTU probes
+
+			if elem.packet[0] == 0 {
+				continue
+			}
+
 			// verify source and strip padding
 
 			switch elem.packet[0] >> 4 {
@@ -561,8 +707,19 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				continue
 			}
 
-			_, err := device.tun.device.Write(elem.packet)
-			device.PutMessageBuffer(elem.buffer)
+			if !device.firewall.Allow(FirewallIn, elem.packet) {
+				continue
+			}
+
+			if device.mssClamp.Get() {
+				clampMSS(elem.packet, device.MTU())
+			}
+			device.capture.Write(elem.packet)
+			device.snoopDNS(elem.packet)
+			device.flows.Track(elem.packet, false)
+			// the packet follows the transport header, which leaves headroom for framing
+			end := MessageTransportOffsetContent + len(elem.packet)
+			err := device.tun.device.WritePacket(elem.buffer[:end], MessageTransportOffsetContent)
 			if err != nil {
 				logger.Wlog.SaveErrLog("Failed to write packet to TUN device:" + err.Error())
 			}
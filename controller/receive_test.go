@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+/* Queues the messages for decryption by workers, in the order
+ * addToDecryptionQueue would, and hands the decrypted packets
+ * to consume in the order they were queued
+ */
+func decryptInOrder(device *Device, keyPair *KeyPair, workers, count int, messages [][]byte, consume func(i int, elem *QueueInboundElement)) {
+	for i := 0; i < workers; i++ {
+		go device.RoutineDecryption()
+	}
+
+	inbound := make(chan *QueueInboundElement, QueueInboundSize)
+	go func() {
+		for i := 0; i < count; i++ {
+			message := messages[i%len(messages)]
+			elem := &QueueInboundElement{
+				buffer:  device.GetMessageBuffer(),
+				keyPair: keyPair,
+			}
+			elem.packet = elem.buffer[:copy(elem.buffer[:], message)]
+			elem.mutex.Lock()
+			device.queue.decryption <- elem
+			inbound <- elem
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		elem := <-inbound
+		elem.mutex.Lock()
+		consume(i, elem)
+		device.PutMessageBuffer(elem.buffer)
+	}
+}
+
+/* Encrypts count messages carrying their index
+ */
+func encryptMessages(keyPair *KeyPair, count, size int) [][]byte {
+	device := newTestDevice(DefaultMTU)
+	defer close(device.signal.stop)
+
+	messages := make([][]byte, count)
+	encryptInOrder(device, keyPair, 1, count, size, func(i int, message []byte) {
+		messages[i] = append([]byte{}, message...)
+	})
+	return messages
+}
+
+func TestDecryptionOrder(t *testing.T) {
+	keyPair := newTestKeyPair()
+	messages := encryptMessages(keyPair, 2048, 1000)
+	messages[7][MessageTransportOffsetContent] ^= 1
+
+	for _, workers := range []int{1, 4, 16} {
+		device := newTestDevice(DefaultMTU)
+		decryptInOrder(device, keyPair, workers, len(messages), messages, func(i int, elem *QueueInboundElement) {
+			if elem.counter != uint64(i) {
+				t.Fatalf("%d workers: packet %d has counter %d", workers, i, elem.counter)
+			}
+			if i == 7 {
+				if !elem.IsDropped() {
+					t.Fatalf("%d workers: tampered packet accepted", workers)
+				}
+				return
+			}
+			if elem.IsDropped() {
+				t.Fatalf("%d workers: packet %d dropped", workers, i)
+			}
+			if index := binary.BigEndian.Uint32(elem.packet); index != uint32(i) || len(elem.packet) != 1008 {
+				t.Fatalf("%d workers: packet %d decrypted to index %d, %d bytes", workers, i, index, len(elem.packet))
+			}
+		})
+		close(device.signal.stop)
+		if n := device.memory.InFlight(); n != 0 {
+			t.Errorf("%d workers: %d buffers not returned", workers, n)
+		}
+	}
+}
+
+func BenchmarkDecryption(b *testing.B) {
+	keyPair := newTestKeyPair()
+	messages := encryptMessages(keyPair, 1024, DefaultMTU)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			device := newTestDevice(DefaultMTU)
+			defer close(device.signal.stop)
+
+			b.SetBytes(DefaultMTU)
+			b.ResetTimer()
+			decryptInOrder(device, keyPair, workers, b.N, messages, func(i int, elem *QueueInboundElement) {
+				if elem.IsDropped() || elem.counter != uint64(i%len(messages)) {
+					b.Fatal("packet dropped or out of order")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bt/logger"
+)
+
+/* Region bypass list
+ *
+ * A compact list of prefixes (e.g. the IP set of a country) kept as sorted,
+ * merged address ranges and looked up by binary search.
+ * Traffic to these addresses does not go through the tunnel.
+ *
+ * The file holds one prefix (or address) per line, "#" starts a comment.
+ */
+
+const (
+	BypassReloadInterval = time.Second * 30
+)
+
+type ipv4Range struct {
+	start uint32
+	end   uint32
+}
+
+type ipv6Range struct {
+	start [net.IPv6len]byte
+	end   [net.IPv6len]byte
+}
+
+type RegionSet struct {
+	ipv4     []ipv4Range
+	ipv6     []ipv6Range
+	prefixes []net.IPNet
+}
+
+func lastAddress(network *net.IPNet) net.IP {
+	last := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return last
+}
+
+func ParseRegionSet(data []byte) (*RegionSet, error) {
+	set := new(RegionSet)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		s := scanner.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		set.prefixes = append(set.prefixes, *network)
+
+		last := lastAddress(network)
+		if len(network.IP) == net.IPv4len {
+			set.ipv4 = append(set.ipv4, ipv4Range{
+				start: binary.BigEndian.Uint32(network.IP),
+				end:   binary.BigEndian.Uint32(last),
+			})
+		} else {
+			var r ipv6Range
+			copy(r.start[:], network.IP)
+			copy(r.end[:], last)
+			set.ipv6 = append(set.ipv6, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// sort and merge overlapping ranges
+
+	sort.Slice(set.ipv4, func(i, j int) bool {
+		return set.ipv4[i].start < set.ipv4[j].start
+	})
+	merged4 := set.ipv4[:0]
+	for _, r := range set.ipv4 {
+		n := len(merged4)
+		if n > 0 && (r.start <= merged4[n-1].end || r.start == merged4[n-1].end+1) {
+			if r.end > merged4[n-1].end {
+				merged4[n-1].end = r.end
+			}
+			continue
+		}
+		merged4 = append(merged4, r)
+	}
+	set.ipv4 = merged4
+
+	sort.Slice(set.ipv6, func(i, j int) bool {
+		return bytes.Compare(set.ipv6[i].start[:], set.ipv6[j].start[:]) < 0
+	})
+	merged6 := set.ipv6[:0]
+	for _, r := range set.ipv6 {
+		n := len(merged6)
+		if n > 0 && (bytes.Compare(r.start[:], merged6[n-1].end[:]) <= 0 || isNextIPv6(merged6[n-1].end, r.start)) {
+			if bytes.Compare(r.end[:], merged6[n-1].end[:]) > 0 {
+				merged6[n-1].end = r.end
+			}
+			continue
+		}
+		merged6 = append(merged6, r)
+	}
+	set.ipv6 = merged6
+
+	return set, nil
+}
+
+/* Reports whether next directly follows address
+ */
+func isNextIPv6(address, next [16]byte) bool {
+	for i := len(address) - 1; i >= 0; i-- {
+		address[i]++
+		if address[i] != 0 {
+			return address == next
+		}
+	}
+	return false // address was the last one
+}
+
+func (set *RegionSet) ContainsIPv4(address []byte) bool {
+	ip := binary.BigEndian.Uint32(address)
+	i := sort.Search(len(set.ipv4), func(i int) bool {
+		return set.ipv4[i].end >= ip
+	})
+	return i < len(set.ipv4) && set.ipv4[i].start <= ip
+}
+
+func (set *RegionSet) ContainsIPv6(address []byte) bool {
+	i := sort.Search(len(set.ipv6), func(i int) bool {
+		return bytes.Compare(set.ipv6[i].end[:], address) >= 0
+	})
+	return i < len(set.ipv6) && bytes.Compare(set.ipv6[i].start[:], address) <= 0
+}
+
+func (set *RegionSet) Contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return set.ContainsIPv4(ip4)
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return set.ContainsIPv6(ip6)
+	}
+	return false
+}
+
+/* Bypass list of the device, swapped atomically on reload
+ */
+type Bypass struct {
+	set     atomic.Value // *RegionSet
+	mutex   sync.Mutex
+	path    string
+	modTime time.Time
+}
+
+func (bypass *Bypass) current() *RegionSet {
+	set, _ := bypass.set.Load().(*RegionSet)
+	return set
+}
+
+func (bypass *Bypass) ContainsIPv4(address []byte) bool {
+	set := bypass.current()
+	return set != nil && set.ContainsIPv4(address)
+}
+
+func (bypass *Bypass) ContainsIPv6(address []byte) bool {
+	set := bypass.current()
+	return set != nil && set.ContainsIPv6(address)
+}
+
+func (bypass *Bypass) Contains(ip net.IP) bool {
+	set := bypass.current()
+	return set != nil && set.Contains(ip)
+}
+
+func (bypass *Bypass) Prefixes() []net.IPNet {
+	set := bypass.current()
+	if set == nil {
+		return nil
+	}
+	return set.prefixes
+}
+
+/* Loads the list from path, an empty path clears the list
+ */
+func (bypass *Bypass) Load(path string) error {
+	bypass.mutex.Lock()
+	defer bypass.mutex.Unlock()
+
+	bypass.path = path
+	bypass.modTime = time.Time{}
+	if path == "" {
+		bypass.set.Store((*RegionSet)(nil))
+		return nil
+	}
+	return bypass.reloadLocked(true)
+}
+
+func (bypass *Bypass) Reload() error {
+	bypass.mutex.Lock()
+	defer bypass.mutex.Unlock()
+
+	if bypass.path == "" {
+		return errors.New("no bypass list loaded")
+	}
+	return bypass.reloadLocked(true)
+}
+
+/* Caller must hold the bypass mutex
+ */
+func (bypass *Bypass) reloadLocked(force bool) error {
+	info, err := os.Stat(bypass.path)
+	if err != nil {
+		return err
+	}
+	if !force && info.ModTime().Equal(bypass.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(bypass.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(file); err != nil {
+		return err
+	}
+	set, err := ParseRegionSet(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+
+	bypass.set.Store(set)
+	bypass.modTime = info.ModTime()
+	logger.Wlog.SaveInfoLog(fmt.Sprintf("bypass list loaded:%s,ipv4 ranges:%d,ipv6 ranges:%d", bypass.path, len(set.ipv4), len(set.ipv6)))
+	return nil
+}
+
+/* Reloads the bypass list when the file changes
+ */
+func (device *Device) RoutineBypassReload() {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Wlog.SaveErrLog(fmt.Sprintln("recover RoutineBypassReload err:", err))
+		}
+	}()
+
+	t := time.NewTicker(BypassReloadInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-device.signal.stop:
+			return
+		case <-t.C:
+			bypass := &device.bypass
+			bypass.mutex.Lock()
+			if bypass.path != "" {
+				if err := bypass.reloadLocked(false); err != nil {
+					logger.Wlog.SaveErrLog("Failed to reload bypass list:" + err.Error())
+				}
+			}
+			bypass.mutex.Unlock()
+		}
+	}
+}
@@ -9,9 +9,11 @@ import (
 )
 
 type RoutingTable struct {
-	IPv4  *Trie
-	IPv6  *Trie
-	mutex sync.RWMutex
+	IPv4    *Trie
+	IPv6    *Trie
+	include []net.IPNet // configured split tunneling prefixes
+	exclude []net.IPNet
+	mutex   sync.RWMutex
 }
 
 func (table *RoutingTable) AllowedIPs(peer *Peer) []net.IPNet {
@@ -30,6 +32,8 @@ func (table *RoutingTable) Reset() {
 
 	table.IPv4 = nil
 	table.IPv6 = nil
+	table.include = nil
+	table.exclude = nil
 }
 
 func (table *RoutingTable) RemovePeer(peer *Peer) {
@@ -40,21 +44,86 @@ func (table *RoutingTable) RemovePeer(peer *Peer) {
 	table.IPv6 = table.IPv6.RemovePeer(peer)
 }
 
-func (table *RoutingTable) Insert(ip net.IP, cidr uint, peer *Peer) {
+func (table *RoutingTable) Insert(ip net.IP, cidr uint, peer *Peer, source int) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
 	switch len(ip) {
 	case net.IPv6len:
-		table.IPv6 = table.IPv6.Insert(ip, cidr, peer)
+		table.IPv6 = table.IPv6.Insert(ip, cidr, peer, source)
 	case net.IPv4len:
-		table.IPv4 = table.IPv4.Insert(ip, cidr, peer)
+		table.IPv4 = table.IPv4.Insert(ip, cidr, peer, source)
 	default:
 		logger.Wlog.SaveErrLog("Inserting unknown address type")
 		panic(errors.New("Inserting unknown address type"))
 	}
 }
 
+func (table *RoutingTable) Remove(ip net.IP, cidr uint, source int) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	switch len(ip) {
+	case net.IPv6len:
+		table.IPv6 = table.IPv6.Remove(ip, cidr, source)
+	case net.IPv4len:
+		table.IPv4 = table.IPv4.Remove(ip, cidr, source)
+	}
+}
+
+func (table *RoutingTable) InsertExclude(ip net.IP, cidr uint) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	switch len(ip) {
+	case net.IPv6len:
+		table.IPv6 = table.IPv6.InsertExclude(ip, cidr)
+	case net.IPv4len:
+		table.IPv4 = table.IPv4.InsertExclude(ip, cidr)
+	default:
+		logger.Wlog.SaveErrLog("Inserting unknown address type")
+		panic(errors.New("Inserting unknown address type"))
+	}
+}
+
+/* Routes the prefix through the tunnel (split tunneling include list)
+ */
+func (table *RoutingTable) Include(network *net.IPNet, peer *Peer) {
+	ones, _ := network.Mask.Size()
+	table.Insert(network.IP, uint(ones), peer, RouteSourceConfig)
+
+	table.mutex.Lock()
+	table.include = append(table.include, *network)
+	table.mutex.Unlock()
+}
+
+/* Routes the prefix outside the tunnel (split tunneling exclude list)
+ */
+func (table *RoutingTable) Exclude(network *net.IPNet) {
+	ones, _ := network.Mask.Size()
+	table.InsertExclude(network.IP, uint(ones))
+
+	table.mutex.Lock()
+	table.exclude = append(table.exclude, *network)
+	table.mutex.Unlock()
+}
+
+/* Routes the apps must install on the VPN builder:
+ * the include list (and any extra includes) minus the exclude list (and any extra excludes)
+ */
+func (table *RoutingTable) Routes(extraInclude, extraExclude []net.IPNet) []net.IPNet {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	include := make([]net.IPNet, 0, len(table.include)+len(extraInclude))
+	include = append(include, table.include...)
+	include = append(include, extraInclude...)
+	exclude := make([]net.IPNet, 0, len(table.exclude)+len(extraExclude))
+	exclude = append(exclude, table.exclude...)
+	exclude = append(exclude, extraExclude...)
+	return SubtractRoutes(include, exclude)
+}
+
 func (table *RoutingTable) LookupIPv4(address []byte) *Peer {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
@@ -66,3 +135,18 @@ func (table *RoutingTable) LookupIPv6(address []byte) *Peer {
 	defer table.mutex.RUnlock()
 	return table.IPv6.Lookup(address)
 }
+
+/* Returns the peer routing address,
+ * excluded is true when the address is excluded from the tunnel
+ */
+func (table *RoutingTable) RouteIPv4(address []byte) (*Peer, bool) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.IPv4.LookupRoute(address)
+}
+
+func (table *RoutingTable) RouteIPv6(address []byte) (*Peer, bool) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.IPv6.LookupRoute(address)
+}
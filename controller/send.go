@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -44,15 +45,19 @@ type QueueOutboundElement struct {
 	nonce   uint64                // nonce for encryption
 	keyPair *KeyPair              // key-pair for encryption
 	peer    *Peer                 // related peer
+	probe   bool                  // padded keepalive used for path MTU discovery
+	queued  time.Time             // when the packet was read from the TUN
 }
 
 func (peer *Peer) FlushNonceQueue() {
-	elems := len(peer.queue.nonce)
-	for i := 0; i < elems; i++ {
-		select {
-		case <-peer.queue.nonce:
-		default:
-			return
+	for _, lane := range peer.queue.nonce {
+		elems := len(lane)
+		for i := 0; i < elems; i++ {
+			select {
+			case elem := <-lane:
+				peer.device.PutMessageBuffer(elem.buffer)
+			default:
+			}
 		}
 	}
 }
@@ -60,7 +65,7 @@ func (peer *Peer) FlushNonceQueue() {
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	return &QueueOutboundElement{
 		dropped: AtomicFalse,
-		buffer:  device.pool.messageBuffers.Get().(*[MaxMessageSize]byte),
+		buffer:  device.GetMessageBuffer(),
 	}
 }
 
@@ -72,51 +77,84 @@ func (elem *QueueOutboundElement) IsDropped() bool {
 	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
 }
 
-func addToOutboundQueue(queue chan *QueueOutboundElement, element *QueueOutboundElement) {
-	for {
-		select {
-		case queue <- element:
-			return
-		default:
-			select {
-			case old := <-queue:
-				old.Drop()
-			default:
-			}
-		}
+func (peer *Peer) SendBuffer(buffer []byte) (int, error) {
+	if obfuscator := peer.device.obfuscation.Get(); obfuscator != nil {
+		buffer = obfuscator.Obfuscate(buffer)
 	}
+	return peer.send(buffer)
 }
 
-func addToEncryptionQueue(queue chan *QueueOutboundElement, element *QueueOutboundElement) {
-	for {
-		select {
-		case queue <- element:
-			return
-		default:
-			select {
-			case old := <-queue:
-				// drop & release to potential consumer
-				old.Drop()
-				old.mutex.Unlock()
-			default:
-			}
+func (peer *Peer) send(buffer []byte) (int, error) {
+	peer.device.net.mutex.RLock()
+	defer peer.device.net.mutex.RUnlock()
+
+	peer.mutex.RLock()
+	defer peer.mutex.RUnlock()
+
+	var n int
+	var err error
+	if peer.transport != nil && peer.endpoint != nil {
+		n, err = peer.transport.SendTo(buffer, peer.endpoint)
+	} else {
+		transport := peer.device.net.transport
+		if transport == nil {
+			return 0, errors.New("No UDP socket for device")
 		}
+		n, err = transport.Send(buffer)
+	}
+	if err == nil {
+		peer.device.counters.Sent(n)
 	}
+
+	return n, err
 }
 
-func (peer *Peer) SendBuffer(buffer []byte) (int, error) {
+/* Obfuscates and sends several messages in as few system calls
+ * as the transport allows, returns the number of messages sent
+ */
+func (peer *Peer) SendBuffers(buffers [][]byte) (int, error) {
+	if obfuscator := peer.device.obfuscation.Get(); obfuscator != nil {
+		for i := range buffers {
+			buffers[i] = obfuscator.Obfuscate(buffers[i])
+		}
+	}
+
 	peer.device.net.mutex.RLock()
 	defer peer.device.net.mutex.RUnlock()
 
 	peer.mutex.RLock()
 	defer peer.mutex.RUnlock()
 
-	conn := peer.device.net.conn
-	if conn == nil {
+	transport := peer.device.net.transport
+	var addr *net.UDPAddr
+	if peer.transport != nil && peer.endpoint != nil {
+		transport = peer.transport
+		addr = peer.endpoint
+	}
+	if transport == nil {
 		return 0, errors.New("No UDP socket for device")
 	}
 
-	n, err := conn.Write(buffer)
+	var n int
+	var err error
+	if batch, ok := transport.(BatchTransport); ok {
+		n, err = batch.SendBatch(buffers, addr)
+	} else {
+		for n < len(buffers) {
+			if addr != nil {
+				_, err = transport.SendTo(buffers[n], addr)
+			} else {
+				_, err = transport.Send(buffers[n])
+			}
+			if err != nil {
+				break
+			}
+			n++
+		}
+	}
+	for _, buffer := range buffers[:n] {
+		peer.device.counters.Sent(len(buffer))
+	}
 
 	return n, err
 }
@@ -133,10 +171,15 @@ func (device *Device) RoutineReadFromTUN() {
 		}
 	}()
 
-	elem := device.NewOutboundElement()
-
 	logger.Wlog.SaveDebugLog("Routine, TUN Reader started")
 
+	if device.tun.device.Offload() {
+		device.readOffloadTUN()
+		return
+	}
+
+	elem := device.NewOutboundElement()
+
 	for {
 		select {
 		case <-device.signal.stop:
@@ -145,8 +188,7 @@ func (device *Device) RoutineReadFromTUN() {
 
 		default:
 			// read packet
-			elem.packet = elem.buffer[MessageTransportHeaderSize:]
-			recvPacket, err := device.tun.device.Read(elem.packet)
+			recvPacket, err := device.tun.device.Read(elem.buffer[:], MessageTransportHeaderSize)
 			if err != nil {
 				logger.Wlog.SaveErrLog("Failed to read packet from TUN device:" + err.Error())
 				sendStatus(101)
@@ -155,51 +197,138 @@ func (device *Device) RoutineReadFromTUN() {
 
 			length := len(recvPacket)
 
-			if length == 0 || length > MaxContentSize {
+			if length == 0 {
+				continue
+			}
+			if mtu := device.MTU(); length > MaxContentSize || length > mtu {
+				if mtu > MaxContentSize {
+					mtu = MaxContentSize
+				}
+				device.sendPacketTooBig(recvPacket, mtu)
+				continue
+			}
+			if device.overBudget() {
 				continue
 			}
 
 			elem.packet = recvPacket
+			if device.queueFromTUN(elem) {
+				elem = device.NewOutboundElement()
+			}
+		}
+	}
+}
 
-			// lookup peer
+/* Reads super-packets from a TUN with offloads
+ * and queues their segments
+ */
+func (device *Device) readOffloadTUN() {
+	var elems []*QueueOutboundElement
 
-			//if IsCallbackIp == 1 {
-			//	desIp := elem.packet[16:20]
-			//	ipstr := net.IPv4(desIp[0], desIp[1], desIp[2], desIp[3]).String()
-			//	go sendDestinationIP(ipstr)
-			//}
+	for {
+		select {
+		case <-device.signal.stop:
+			logger.Wlog.SaveDebugLog("Routine, TUN Reader worker, stopped")
+			return
 
-			var peer *Peer
-			switch elem.packet[0] >> 4 {
-			case ipv4.Version:
-				if len(elem.packet) < ipv4.HeaderLen {
-					continue
+		default:
+			mtu := device.MTU()
+			if mtu > MaxContentSize {
+				mtu = MaxContentSize
+			}
+			elems = elems[:0]
+			_, err := device.tun.device.ReadSegments(mtu, func(size int) []byte {
+				if device.overBudget() {
+					return nil
 				}
-				dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
-				peer = device.routingTable.LookupIPv4(dst)
-
-			case ipv6.Version:
-				if len(elem.packet) < ipv6.HeaderLen {
+				elem := device.NewOutboundElement()
+				elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+				elems = append(elems, elem)
+				return elem.packet
+			}, func(packet []byte) {
+				device.sendPacketTooBig(packet, mtu)
+			})
+			if err != nil {
+				for _, elem := range elems {
+					device.PutMessageBuffer(elem.buffer)
+				}
+				if _, ok := err.(syscall.Errno); !ok {
+					logger.Wlog.SaveDebugLog("Dropped super-packet from TUN device:" + err.Error())
 					continue
 				}
-				dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
-				peer = device.routingTable.LookupIPv6(dst)
-
-			default:
-				logger.Wlog.SaveDebugLog(fmt.Sprintln("Receieved packet with unknown IP version:", len(elem.packet),
-					elem.packet[0]>>4, hex.EncodeToString(elem.packet)))
+				logger.Wlog.SaveErrLog("Failed to read packet from TUN device:" + err.Error())
+				sendStatus(101)
+				return
 			}
 
-			if peer == nil {
-				continue
+			for _, elem := range elems {
+				if !device.queueFromTUN(elem) {
+					device.PutMessageBuffer(elem.buffer)
+				}
 			}
+		}
+	}
+}
+
+/* Routes a packet read from the TUN into the nonce queue of the peer,
+ * returns false when the packet is dropped and its element may be reused
+ */
+func (device *Device) queueFromTUN(elem *QueueOutboundElement) bool {
+	if device.mssClamp.Get() {
+		clampMSS(elem.packet, device.MTU())
+	}
+	if !device.firewall.Allow(FirewallOut, elem.packet) {
+		return false
+	}
+	device.capture.Write(elem.packet)
+	device.snoopDNS(elem.packet)
+
+	// lookup peer, destinations excluded or bypassed on purpose
+	// are dropped silently, the others get destination unreachable
+
+	var peer *Peer
+	var bypassed bool
+	switch elem.packet[0] >> 4 {
+	case ipv4.Version:
+		if len(elem.packet) < ipv4.HeaderLen {
+			return false
+		}
+		dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+		peer, bypassed = device.routingTable.RouteIPv4(dst)
+		if peer != nil && device.bypass.ContainsIPv4(dst) {
+			peer, bypassed = nil, true
+		}
+
+	case ipv6.Version:
+		if len(elem.packet) < ipv6.HeaderLen {
+			return false
+		}
+		dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+		peer, bypassed = device.routingTable.RouteIPv6(dst)
+		if peer != nil && device.bypass.ContainsIPv6(dst) {
+			peer, bypassed = nil, true
+		}
+
+	default:
+		logger.Wlog.SaveDebugLog(fmt.Sprintln("Receieved packet with unknown IP version:", len(elem.packet),
+			elem.packet[0]>>4, hex.EncodeToString(elem.packet)))
+	}
 
-			// insert into nonce/pre-handshake queue
-			signalSend(peer.signal.handshakeReset)
-			addToOutboundQueue(peer.queue.nonce, elem)
-			elem = device.NewOutboundElement()
+	if peer == nil {
+		if !bypassed {
+			device.sendUnreachable(elem.packet)
 		}
+		return false
+	}
+
+	// insert into nonce/pre-handshake queue
+	signalSend(peer.signal.handshakeReset)
+	if !device.filterLeaks(peer, elem) {
+		return false
 	}
+	sent := device.flows.Track(elem.packet, true)
+	device.addToNonceQueue(peer, classifyPacket(elem.packet, sent), elem)
+	return true
 }
 
 /* Queues packets when there is no handshake.
@@ -221,46 +350,59 @@ func (peer *Peer) RoutineNonce() {
 
 	for {
 	NextPacket:
-		select {
-		case <-peer.signal.stop:
+		elem, ok := peer.nextNonceElement()
+		if !ok {
 			return
-		case elem, ok := <-peer.queue.nonce:
-			if !ok {
-				return
-			}
-			// wait for key pair
-			for {
-				keyPair = peer.keyPairs.Current()
-				if keyPair != nil && keyPair.sendNonce < RejectAfterMessages {
-					if time.Now().Sub(keyPair.created) < RejectAfterTime {
-						break
-					}
+		}
+
+		// wait for key pair
+		for {
+			keyPair = peer.keyPairs.Current()
+			if keyPair != nil && keyPair.sendNonce < RejectAfterMessages {
+				if time.Now().Sub(keyPair.created) < RejectAfterTime {
+					break
 				}
+			}
 
-				signalSend(peer.signal.handshakeBegin)
-				logger.Wlog.SaveDebugLog("Awaiting key-pair for " + peer.String())
+			signalSend(peer.signal.handshakeBegin)
+			logger.Wlog.SaveDebugLog("Awaiting key-pair for " + peer.String())
 
-				select {
-				case <-peer.signal.newKeyPair:
-				case <-peer.signal.flushNonceQueue:
-					logger.Wlog.SaveDebugLog("Clearing queue for" + peer.String())
-					peer.FlushNonceQueue()
-					goto NextPacket
-				case <-peer.signal.stop:
-					return
-				}
+			select {
+			case <-peer.signal.newKeyPair:
+			case <-peer.signal.flushNonceQueue:
+				logger.Wlog.SaveDebugLog("Clearing queue for" + peer.String())
+				peer.FlushNonceQueue()
+				device.PutMessageBuffer(elem.buffer)
+				goto NextPacket
+			case <-peer.signal.stop:
+				return
 			}
+		}
 
-			// populate work element
-			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keyPair.sendNonce, 1) - 1
-			elem.keyPair = keyPair
-			elem.dropped = AtomicFalse
-			elem.mutex.Lock()
+		if device.expired(elem) {
+			device.PutMessageBuffer(elem.buffer)
+			device.counters.LeakDropped(LeakDropExpired)
+			continue
+		}
+
+		// populate work element
+		elem.peer = peer
+		elem.nonce = atomic.AddUint64(&keyPair.sendNonce, 1) - 1
+		elem.keyPair = keyPair
+		elem.dropped = AtomicFalse
+		elem.mutex.Lock()
 
-			// add to parallel and sequential queue
-			addToEncryptionQueue(device.queue.encryption, elem)
-			addToOutboundQueue(peer.queue.outbound, elem)
+		// add to parallel and sequential queue, waiting for room
+		// (packets are only dropped in the priority lanes)
+		select {
+		case device.queue.encryption <- elem:
+		case <-peer.signal.stop:
+			return
+		}
+		select {
+		case peer.queue.outbound <- elem:
+		case <-peer.signal.stop:
+			return
 		}
 	}
 }
@@ -346,6 +488,9 @@ func (peer *Peer) RoutineSequentialSender() {
 
 	logger.Wlog.SaveDebugLog("Routine, sequential sender, started")
 
+	elems := make([]*QueueOutboundElement, 0, UDPBatchSize)
+	packets := make([][]byte, 0, UDPBatchSize)
+
 	for {
 		select {
 		case <-peer.signal.stop:
@@ -356,30 +501,69 @@ func (peer *Peer) RoutineSequentialSender() {
 			if !ok {
 				return
 			}
-			elem.mutex.Lock()
-			if elem.IsDropped() {
+
+			// drain what is already queued into the batch
+
+			elems = append(elems[:0], elem)
+		drain:
+			for len(elems) < UDPBatchSize {
+				select {
+				case elem, ok := <-peer.queue.outbound:
+					if !ok {
+						break drain
+					}
+					elems = append(elems, elem)
+				default:
+					break drain
+				}
+			}
+
+			packets = packets[:0]
+			sending := elems[:0]
+			for _, elem := range elems {
+				elem.mutex.Lock()
+				if elem.IsDropped() {
+					device.PutMessageBuffer(elem.buffer)
+					continue
+				}
+				sending = append(sending, elem)
+				packets = append(packets, elem.packet)
+			}
+			if len(sending) == 0 {
 				continue
 			}
 
-			// send message and return buffer to pool
-			_, err := peer.SendBuffer(elem.packet)
-			device.PutMessageBuffer(elem.buffer)
+			// send messages and return buffers to pool
+			n, err := peer.SendBuffers(packets)
+			for _, elem := range sending {
+				device.PutMessageBuffer(elem.buffer)
+			}
 			if err != nil {
 				logger.Wlog.SaveDebugLog("Failed to send authenticated packet to peer:" + err.Error())
-				time.Sleep(2 * time.Second)
-				changeNetwork(peer.device, Endpoint)
-
-				continue
 			}
 
 			//UploadFlowNum += n
 
 			// update timers
-			peer.TimerAnyAuthenticatedPacketTraversal()
-			if len(elem.packet) != MessageKeepaliveSize {
-				peer.TimerDataSent()
+			data := false
+			for _, elem := range sending[:n] {
+				peer.TimerAnyAuthenticatedPacketTraversal()
+				if len(elem.packet) != MessageKeepaliveSize && !elem.probe {
+					peer.TimerDataSent()
+					data = true
+				}
+			}
+			if data {
+				device.quality.DataSent()
+			}
+			if n > 0 {
+				peer.KeepKeyFreshSending()
+			}
+
+			if err != nil {
+				time.Sleep(2 * time.Second)
+				changeNetwork(peer.device, Endpoint)
 			}
-			peer.KeepKeyFreshSending()
 		}
 	}
 }
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+/* Queues count packets of size bytes for encryption by workers,
+ * in the order RoutineNonce would, and hands the encrypted
+ * messages to consume in the order they were queued
+ */
+func encryptInOrder(device *Device, keyPair *KeyPair, workers, count, size int, consume func(i int, message []byte)) {
+	for i := 0; i < workers; i++ {
+		go device.RoutineEncryption()
+	}
+
+	outbound := make(chan *QueueOutboundElement, QueueOutboundSize)
+	go func() {
+		for i := 0; i < count; i++ {
+			elem := device.NewOutboundElement()
+			elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+			binary.BigEndian.PutUint32(elem.packet, uint32(i))
+			elem.nonce = uint64(i)
+			elem.keyPair = keyPair
+			elem.mutex.Lock()
+			device.queue.encryption <- elem
+			outbound <- elem
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		elem := <-outbound
+		elem.mutex.Lock()
+		consume(i, elem.packet)
+		device.PutMessageBuffer(elem.buffer)
+	}
+}
+
+func TestEncryptionOrder(t *testing.T) {
+	for _, workers := range []int{1, 4, 16} {
+		device := newTestDevice(DefaultMTU)
+		keyPair := newTestKeyPair()
+		encryptInOrder(device, keyPair, workers, 2048, 1000, func(i int, message []byte) {
+			if nonce := binary.LittleEndian.Uint64(message[MessageTransportOffsetCounter:]); nonce != uint64(i) {
+				t.Fatalf("%d workers: message %d carries nonce %d", workers, i, nonce)
+			}
+			if len(message) != MessageTransportSize+1008 {
+				t.Fatalf("%d workers: message %d is %d bytes, not padded", workers, i, len(message))
+			}
+		})
+		close(device.signal.stop)
+		if n := device.memory.InFlight(); n != 0 {
+			t.Errorf("%d workers: %d buffers not returned", workers, n)
+		}
+	}
+}
+
+func BenchmarkEncryption(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			device := newTestDevice(DefaultMTU)
+			defer close(device.signal.stop)
+			keyPair := newTestKeyPair()
+
+			b.SetBytes(DefaultMTU)
+			b.ResetTimer()
+			encryptInOrder(device, keyPair, workers, b.N, DefaultMTU, func(i int, message []byte) {
+				if binary.LittleEndian.Uint64(message[MessageTransportOffsetCounter:]) != uint64(i) {
+					b.Fatal("message out of order")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"net"
+)
+
+/* Split tunneling route computation
+ *
+ * Android and iOS VPN builders can only add routes,
+ * so the exclude list is turned into the complementary set of prefixes:
+ * every include prefix overlapping an exclude prefix is split in halves
+ * until each half is either disjoint from or covered by the exclude list.
+ */
+
+func prefixContains(outer *net.IPNet, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+func prefixOverlaps(a *net.IPNet, b *net.IPNet) bool {
+	return prefixContains(a, b) || prefixContains(b, a)
+}
+
+/* Splits a prefix into its two halves
+ */
+func splitPrefix(network *net.IPNet) (net.IPNet, net.IPNet) {
+	ones, bits := network.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+
+	low := net.IPNet{IP: make(net.IP, len(network.IP)), Mask: mask}
+	copy(low.IP, network.IP)
+
+	high := net.IPNet{IP: make(net.IP, len(network.IP)), Mask: mask}
+	copy(high.IP, network.IP)
+	high.IP[ones/8] |= 0x80 >> uint(ones%8)
+
+	return low, high
+}
+
+func subtractPrefix(network net.IPNet, exclude []net.IPNet, results []net.IPNet) []net.IPNet {
+
+	// only pass the overlapping prefixes on to the halves
+
+	var overlapping []net.IPNet
+	for i := range exclude {
+		if prefixContains(&exclude[i], &network) {
+			return results
+		}
+		if prefixOverlaps(&exclude[i], &network) {
+			overlapping = append(overlapping, exclude[i])
+		}
+	}
+	if len(overlapping) == 0 {
+		return append(results, network)
+	}
+
+	low, high := splitPrefix(&network)
+	results = subtractPrefix(low, overlapping, results)
+	results = subtractPrefix(high, overlapping, results)
+	return results
+}
+
+/* Returns the prefixes covering include but none of exclude
+ */
+func SubtractRoutes(include []net.IPNet, exclude []net.IPNet) []net.IPNet {
+	results := make([]net.IPNet, 0, len(include))
+	for _, network := range include {
+		results = subtractPrefix(network, exclude, results)
+	}
+	return results
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* Handshake failure reasons
+ */
+const (
+	HandshakeFailureInvalidMAC1 = iota
+	HandshakeFailureDecode
+	HandshakeFailureInvalidInitiation
+	HandshakeFailureInvalidResponse
+	HandshakeFailureCreate
+	HandshakeFailureSend
+	HandshakeFailureTimeout
+	HandshakeFailureRatelimit
+	HandshakeFailureCount
+)
+
+var handshakeFailureNames = [HandshakeFailureCount]string{
+	"invalid_mac1",
+	"decode",
+	"invalid_initiation",
+	"invalid_response",
+	"create",
+	"send",
+	"timeout",
+	"ratelimit",
+}
+
+/* Queues in which elements are dropped when full
+ */
+const (
+	QueueDropOutbound   = iota
+	QueueDropEncryption // kept for the stats, the encryption queue no longer drops
+	QueueDropInbound
+	QueueDropDecryption
+	QueueDropHandshake
+	QueueDropMemory
+	QueueDropCount
+)
+
+var queueDropNames = [QueueDropCount]string{
+	"outbound",
+	"encryption",
+	"inbound",
+	"decryption",
+	"handshake",
+	"memory",
+}
+
+/* Counters maintained on the data path,
+ * all fields are accessed atomically and must stay 64-bit,
+ * the struct is the first field of the device
+ */
+type Counters struct {
+	rxBytes   uint64
+	rxPackets uint64
+	txBytes   uint64
+	txPackets uint64
+
+	handshakeInitiationSent     uint64
+	handshakeInitiationReceived uint64
+	handshakeResponseSent       uint64
+	handshakeResponseReceived   uint64
+	handshakeFailures           [HandshakeFailureCount]uint64
+
+	cookieReplySent     uint64
+	cookieReplyReceived uint64
+
+	queueDrops [QueueDropCount]uint64
+	laneDrops  [PriorityLaneCount]uint64
+	leakDrops  [LeakDropCount]uint64
+}
+
+func (c *Counters) Received(size int) {
+	atomic.AddUint64(&c.rxBytes, uint64(size))
+	atomic.AddUint64(&c.rxPackets, 1)
+}
+
+func (c *Counters) Sent(size int) {
+	atomic.AddUint64(&c.txBytes, uint64(size))
+	atomic.AddUint64(&c.txPackets, 1)
+}
+
+func (c *Counters) HandshakeFailed(reason int) {
+	atomic.AddUint64(&c.handshakeFailures[reason], 1)
+}
+
+func (c *Counters) QueueDropped(queue int) {
+	atomic.AddUint64(&c.queueDrops[queue], 1)
+}
+
+func (c *Counters) inc(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+/* Snapshot of the device state reported through the stats API
+ */
+type Stats struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+
+	HandshakeInitiationSent     uint64            `json:"handshake_initiation_sent"`
+	HandshakeInitiationReceived uint64            `json:"handshake_initiation_received"`
+	HandshakeResponseSent       uint64            `json:"handshake_response_sent"`
+	HandshakeResponseReceived   uint64            `json:"handshake_response_received"`
+	HandshakeFailures           map[string]uint64 `json:"handshake_failures"`
+
+	CookieReplySent     uint64 `json:"cookie_reply_sent"`
+	CookieReplyReceived uint64 `json:"cookie_reply_received"`
+
+	QueueDrops      map[string]uint64   `json:"queue_drops"`
+	LaneDrops       map[string]uint64   `json:"lane_drops"`
+	LeakDrops       map[string]uint64   `json:"leak_drops"`
+	Firewall        []FirewallRuleStats `json:"firewall"`
+	BuffersInFlight int                 `json:"buffers_in_flight"`
+
+	KeyPairAge float64 `json:"keypair_age_seconds"` // -1 when there is no current key-pair
+	Endpoint   string  `json:"endpoint"`
+	Transport  string  `json:"transport"`
+	MTU        int     `json:"mtu"`
+	Flows      int     `json:"flows"` // tracked flows, 0 when flow tracking is off
+
+	Quality QualitySnapshot `json:"quality"`
+}
+
+func (device *Device) Stats() Stats {
+	c := &device.counters
+	stats := Stats{
+		RxBytes:                     atomic.LoadUint64(&c.rxBytes),
+		RxPackets:                   atomic.LoadUint64(&c.rxPackets),
+		TxBytes:                     atomic.LoadUint64(&c.txBytes),
+		TxPackets:                   atomic.LoadUint64(&c.txPackets),
+		HandshakeInitiationSent:     atomic.LoadUint64(&c.handshakeInitiationSent),
+		HandshakeInitiationReceived: atomic.LoadUint64(&c.handshakeInitiationReceived),
+		HandshakeResponseSent:       atomic.LoadUint64(&c.handshakeResponseSent),
+		HandshakeResponseReceived:   atomic.LoadUint64(&c.handshakeResponseReceived),
+		HandshakeFailures:           make(map[string]uint64, HandshakeFailureCount),
+		CookieReplySent:             atomic.LoadUint64(&c.cookieReplySent),
+		CookieReplyReceived:         atomic.LoadUint64(&c.cookieReplyReceived),
+		QueueDrops:                  make(map[string]uint64, QueueDropCount),
+		LaneDrops:                   make(map[string]uint64, PriorityLaneCount),
+		LeakDrops:                   make(map[string]uint64, LeakDropCount),
+		Firewall:                    device.firewall.Stats(),
+		BuffersInFlight:             device.memory.InFlight(),
+		KeyPairAge:                  -1,
+		MTU:                         device.MTU(),
+		Flows:                       device.flows.Len(),
+		Quality:                     device.quality.Snapshot(),
+	}
+
+	for i, name := range handshakeFailureNames {
+		stats.HandshakeFailures[name] = atomic.LoadUint64(&c.handshakeFailures[i])
+	}
+	for i, name := range queueDropNames {
+		stats.QueueDrops[name] = atomic.LoadUint64(&c.queueDrops[i])
+	}
+	for i, name := range priorityLaneNames {
+		stats.LaneDrops[name] = atomic.LoadUint64(&c.laneDrops[i])
+	}
+	for i, name := range leakDropNames {
+		stats.LeakDrops[name] = atomic.LoadUint64(&c.leakDrops[i])
+	}
+
+	if transport := device.primaryTransport(); transport != nil {
+		stats.Transport = transport.Name()
+	}
+
+	peer := device.LookupPeer()
+	if peer == nil {
+		return stats
+	}
+	if kp := peer.keyPairs.Current(); kp != nil {
+		stats.KeyPairAge = time.Now().Sub(kp.created).Seconds()
+	}
+	peer.mutex.RLock()
+	if peer.endpoint != nil {
+		stats.Endpoint = peer.endpoint.String()
+	}
+	peer.mutex.RUnlock()
+
+	return stats
+}
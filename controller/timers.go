@@ -2,7 +2,6 @@ package controller
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"sync/atomic"
@@ -57,14 +56,16 @@ func (peer *Peer) KeepKeyFreshReceiving() {
 func (peer *Peer) SendKeepAlive() bool {
 	elem := peer.device.NewOutboundElement()
 	elem.packet = nil
-	if len(peer.queue.nonce) == 0 {
+	if peer.nonceQueueLen() == 0 {
 		select {
-		case peer.queue.nonce <- elem:
+		case peer.queue.nonce[PriorityLaneControl] <- elem:
 			return true
 		default:
+			peer.device.PutMessageBuffer(elem.buffer)
 			return false
 		}
 	}
+	peer.device.PutMessageBuffer(elem.buffer)
 	return true
 }
 
@@ -239,7 +240,7 @@ func (peer *Peer) RoutineHandshakeInitiator() {
 	}()
 
 	logger.Wlog.SaveDebugLog("Routine, handshake initator, started for " + peer.String())
-	var temp [256]byte
+	var temp [MessageHandshakeSize]byte
 
 	for {
 
@@ -262,6 +263,7 @@ func (peer *Peer) RoutineHandshakeInitiator() {
 			select {
 			case <-deadline.C:
 				logger.Wlog.SaveInfoLog("Handshake negotiation timed out for:" + peer.String())
+				peer.device.counters.HandshakeFailed(HandshakeFailureTimeout)
 				signalSend(peer.signal.flushNonceQueue)
 				timerStop(peer.timer.keepalivePersistent)
 				break
@@ -275,6 +277,7 @@ func (peer *Peer) RoutineHandshakeInitiator() {
 			// create initiation message
 			msg, err := peer.device.CreateMessageInitiation(peer)
 			if err != nil {
+				peer.device.counters.HandshakeFailed(HandshakeFailureCreate)
 				logger.Wlog.SaveErrLog("Failed to create handshake initiation message:" + err.Error())
 				break AttemptHandshakes
 			}
@@ -283,13 +286,18 @@ func (peer *Peer) RoutineHandshakeInitiator() {
 
 			// marshal and send
 
+			if attempts == 1 {
+				peer.SendJunk()
+			}
+
 			writer := bytes.NewBuffer(temp[:0])
-			binary.Write(writer, binary.LittleEndian, msg)
+			msg.marshal(writer)
 			packet := writer.Bytes()
 			peer.mac.AddMacs(packet)
 
 			_, err = peer.SendBuffer(packet)
 			if err != nil {
+				peer.device.counters.HandshakeFailed(HandshakeFailureSend)
 				logger.Wlog.SaveErrLog("Failed to send handshake initiation message: " + err.Error())
 				time.Sleep(2 * time.Second)
 				changeNetwork(peer.device, Endpoint)
@@ -298,6 +306,8 @@ func (peer *Peer) RoutineHandshakeInitiator() {
 			}
 
 			peer.TimerAnyAuthenticatedPacketTraversal()
+			peer.device.counters.inc(&peer.device.counters.handshakeInitiationSent)
+			peer.device.quality.HandshakeSent()
 
 			// set handshake timeout
 			timeout := time.NewTimer(RekeyTimeout + jitter)
@@ -319,6 +329,8 @@ func (peer *Peer) RoutineHandshakeInitiator() {
 
 			case <-timeout.C:
 				// TODO: Clear source address for peer
+				peer.extensions.Unanswered()
+				peer.device.transportFailed()
 				continue
 			}
 		}
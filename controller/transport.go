@@ -0,0 +1,658 @@
+package controller
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"bt/logger"
+)
+
+/* Transports carrying the messages to the server
+ *
+ * UDP is the default. The stream transport frames every message
+ * with a 2 byte big endian length over TCP, optionally wrapped in TLS,
+ * and is used when UDP is blocked: forced by config ("tcp", "websocket")
+ * or selected after repeated handshake failures over UDP ("auto",
+ * WebSocket when a URL is configured, TCP otherwise).
+ */
+
+const (
+	TransportUDP  = "udp"
+	TransportTCP  = "tcp"
+	TransportAuto = "auto"
+)
+
+const (
+	TransportDialTimeout      = time.Second * 10
+	TransportFallbackAttempts = 2 // handshake timeouts over UDP before falling back
+	TransportRetryUDPInterval = time.Minute * 10
+	StreamFrameHeaderSize     = 2
+	StreamListenerBacklog     = 64
+)
+
+type Transport interface {
+	// Send writes a message to the connected endpoint
+	Send(packet []byte) (int, error)
+
+	// SendTo writes a message to the source of a received message
+	SendTo(packet []byte, addr *net.UDPAddr) (int, error)
+
+	// Receive reads the next message into buffer
+	Receive(buffer []byte) (int, *net.UDPAddr, error)
+
+	LocalAddr() net.Addr
+	Close() error
+	Name() string
+}
+
+/* Transports moving several messages per system call
+ */
+type BatchTransport interface {
+	Transport
+
+	// ReceiveBatch reads up to len(buffers) messages, sizes and addrs are filled per message
+	ReceiveBatch(buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error)
+
+	// SendBatch writes the messages to addr (nil for the connected endpoint),
+	// returns the number of messages written
+	SendBatch(packets [][]byte, addr *net.UDPAddr) (int, error)
+}
+
+/* UDP transport
+ */
+type UDPTransport struct {
+	conn  *net.UDPConn
+	batch *udpBatch
+}
+
+func newUDPTransport(conn *net.UDPConn) *UDPTransport {
+	return &UDPTransport{
+		conn:  conn,
+		batch: newUDPBatch(conn),
+	}
+}
+
+func (t *UDPTransport) Send(packet []byte) (int, error) {
+	return t.conn.Write(packet)
+}
+
+func (t *UDPTransport) SendTo(packet []byte, addr *net.UDPAddr) (int, error) {
+	if raddr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && raddr.IP.Equal(addr.IP) && raddr.Port == addr.Port {
+		return t.conn.Write(packet)
+	}
+	return t.conn.WriteToUDP(packet, addr)
+}
+
+func (t *UDPTransport) Receive(buffer []byte) (int, *net.UDPAddr, error) {
+	return t.conn.ReadFromUDP(buffer)
+}
+
+func (t *UDPTransport) ReceiveBatch(buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	return t.batch.receive(t.conn, buffers, sizes, addrs)
+}
+
+func (t *UDPTransport) SendBatch(packets [][]byte, addr *net.UDPAddr) (int, error) {
+	if raddr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr != nil && raddr.IP.Equal(addr.IP) && raddr.Port == addr.Port {
+		addr = nil
+	}
+	return t.batch.send(t.conn, packets, addr)
+}
+
+/* Reads a single datagram, the batch fallback without recvmmsg
+ */
+func receiveSingle(conn *net.UDPConn, buffers [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	if len(buffers) == 0 {
+		return 0, nil
+	}
+	size, addr, err := conn.ReadFromUDP(buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = size
+	addrs[0] = addr
+	return 1, nil
+}
+
+/* Writes the packets one by one, the batch fallback without sendmmsg
+ */
+func sendSingle(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+	for i, packet := range packets {
+		var err error
+		if addr == nil {
+			_, err = conn.Write(packet)
+		} else {
+			_, err = conn.WriteToUDP(packet, addr)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+func (t *UDPTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *UDPTransport) Name() string {
+	return TransportUDP
+}
+
+func streamAddr(addr net.Addr) *net.UDPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: tcp.IP, Port: tcp.Port, Zone: tcp.Zone}
+	}
+	return nil
+}
+
+func writeFrame(conn net.Conn, packet []byte) (int, error) {
+	if len(packet) > MaxMessageSize {
+		return 0, errors.New("message too long")
+	}
+	frame := make([]byte, StreamFrameHeaderSize+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	copy(frame[StreamFrameHeaderSize:], packet)
+	n, err := conn.Write(frame)
+	if n >= StreamFrameHeaderSize {
+		n -= StreamFrameHeaderSize
+	}
+	return n, err
+}
+
+func readFrame(reader io.Reader, buffer []byte) (int, error) {
+	var header [StreamFrameHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buffer) {
+		return 0, errors.New("message too long")
+	}
+	return io.ReadFull(reader, buffer[:size])
+}
+
+/* Client side stream transport
+ */
+type StreamTransport struct {
+	conn   net.Conn
+	local  net.Addr
+	remote *net.UDPAddr
+	name   string
+	mutex  sync.Mutex // serializes frames
+}
+
+func (t *StreamTransport) Send(packet []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return writeFrame(t.conn, packet)
+}
+
+func (t *StreamTransport) SendTo(packet []byte, addr *net.UDPAddr) (int, error) {
+	return t.Send(packet)
+}
+
+func (t *StreamTransport) Receive(buffer []byte) (int, *net.UDPAddr, error) {
+	n, err := readFrame(t.conn, buffer)
+	return n, t.remote, err
+}
+
+func (t *StreamTransport) LocalAddr() net.Addr {
+	return t.local
+}
+
+func (t *StreamTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *StreamTransport) Name() string {
+	return t.name
+}
+
+/* Server side stream listener,
+ * replies go out on the connection the destination was last seen on
+ * (connections come from a TCP listener or from WebSocket requests)
+ */
+type StreamListener struct {
+	listener net.Listener
+	name     string
+	messages chan streamMessage
+	closed   chan struct{}
+	mutex    sync.Mutex
+	conns    map[string]*streamConn
+	last     *streamConn
+}
+
+type streamConn struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+type streamMessage struct {
+	packet []byte
+	source *net.UDPAddr
+}
+
+func ListenStream(addr string, config *tls.Config) (*StreamListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	name := TransportTCP
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+		name = "tls"
+	}
+
+	sl := newStreamListener(listener, name)
+	go sl.accept()
+	return sl, nil
+}
+
+func newStreamListener(listener net.Listener, name string) *StreamListener {
+	return &StreamListener{
+		listener: listener,
+		name:     name,
+		messages: make(chan streamMessage, StreamListenerBacklog),
+		closed:   make(chan struct{}),
+		conns:    make(map[string]*streamConn),
+	}
+}
+
+func (sl *StreamListener) accept() {
+	for {
+		conn, err := sl.listener.Accept()
+		if err != nil {
+			return
+		}
+		sc := &streamConn{conn: conn}
+		key := conn.RemoteAddr().String()
+		if !sl.add(key, sc) {
+			return
+		}
+		go sl.serve(sc, key, streamAddr(conn.RemoteAddr()))
+	}
+}
+
+/* Registers a connection, returns false once the listener is closed
+ */
+func (sl *StreamListener) add(key string, sc *streamConn) bool {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	select {
+	case <-sl.closed:
+		sc.conn.Close()
+		return false
+	default:
+	}
+	sl.conns[key] = sc
+	return true
+}
+
+func (sl *StreamListener) serve(sc *streamConn, key string, source *net.UDPAddr) {
+	defer func() {
+		sl.mutex.Lock()
+		if sl.conns[key] == sc {
+			delete(sl.conns, key)
+		}
+		if sl.last == sc {
+			sl.last = nil
+		}
+		sl.mutex.Unlock()
+		sc.conn.Close()
+	}()
+
+	for {
+		buffer := make([]byte, MaxMessageSize)
+		n, err := readFrame(sc.conn, buffer)
+		if err != nil {
+			return
+		}
+		sl.mutex.Lock()
+		sl.last = sc
+		sl.mutex.Unlock()
+
+		select {
+		case sl.messages <- streamMessage{packet: buffer[:n], source: source}:
+		case <-sl.closed:
+			return
+		}
+	}
+}
+
+func (sl *StreamListener) Send(packet []byte) (int, error) {
+	sl.mutex.Lock()
+	sc := sl.last
+	sl.mutex.Unlock()
+	if sc == nil {
+		return 0, errors.New("no stream connection")
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return writeFrame(sc.conn, packet)
+}
+
+func (sl *StreamListener) SendTo(packet []byte, addr *net.UDPAddr) (int, error) {
+	sl.mutex.Lock()
+	sc := sl.conns[addr.String()]
+	sl.mutex.Unlock()
+	if sc == nil {
+		return 0, errors.New("no stream connection for " + addr.String())
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return writeFrame(sc.conn, packet)
+}
+
+func (sl *StreamListener) Receive(buffer []byte) (int, *net.UDPAddr, error) {
+	select {
+	case msg := <-sl.messages:
+		return copy(buffer, msg.packet), msg.source, nil
+	case <-sl.closed:
+		return 0, nil, errors.New("stream listener closed")
+	}
+}
+
+func (sl *StreamListener) LocalAddr() net.Addr {
+	if sl.listener == nil {
+		return &net.TCPAddr{}
+	}
+	return sl.listener.Addr()
+}
+
+func (sl *StreamListener) Close() error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	select {
+	case <-sl.closed:
+		return nil
+	default:
+	}
+	close(sl.closed)
+	for _, sc := range sl.conns {
+		sc.conn.Close()
+	}
+	if sl.listener == nil {
+		return nil
+	}
+	return sl.listener.Close()
+}
+
+func (sl *StreamListener) Name() string {
+	return sl.name
+}
+
+/* Transport selection of the device
+ */
+type TransportConfig struct {
+	mutex          sync.Mutex
+	mode           string
+	streamEndpoint string // defaults to the UDP endpoint
+	tlsServerName  string // TLS is used when set
+	tlsCertFile    string // certificate of the stream listener
+	tlsKeyFile     string
+	webSocket      WebSocketConfig
+	proxy          string // proxy of the stream transports
+	failures       int
+	fallback       time.Time
+}
+
+/* Returns true if the next connection should use the stream transport
+ */
+func (tc *TransportConfig) useStream() bool {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	switch tc.mode {
+	case TransportTCP, TransportWebSocket:
+		return true
+	case TransportAuto:
+		return !tc.fallback.IsZero() && time.Now().Sub(tc.fallback) < TransportRetryUDPInterval
+	}
+	return false
+}
+
+func (tc *TransportConfig) SetStreamEndpoint(endpoint string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.streamEndpoint = endpoint
+}
+
+func (tc *TransportConfig) SetWebSocketURL(u string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.webSocket.URL = u
+}
+
+func (tc *TransportConfig) SetWebSocketHost(host string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.webSocket.Host = host
+}
+
+func (tc *TransportConfig) SetProxy(proxy string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.proxy = proxy
+}
+
+func (tc *TransportConfig) SetTLSServerName(name string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.tlsServerName = name
+}
+
+/* Sets the certificate and/or key file of the stream listener,
+ * empty arguments keep the current value
+ */
+func (tc *TransportConfig) SetListenerCertificate(certFile string, keyFile string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if certFile != "" {
+		tc.tlsCertFile = certFile
+	}
+	if keyFile != "" {
+		tc.tlsKeyFile = keyFile
+	}
+}
+
+func (device *Device) SetTransport(mode string) error {
+	switch mode {
+	case "", TransportUDP, TransportTCP, TransportWebSocket, TransportAuto:
+	default:
+		return errors.New("invalid transport: " + mode)
+	}
+
+	tc := &device.transport
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.mode = mode
+	tc.failures = 0
+	tc.fallback = time.Time{}
+	return nil
+}
+
+/* Called when a handshake attempt timed out,
+ * switches to the stream transport after repeated failures over UDP
+ */
+func (device *Device) transportFailed() {
+	device.net.mutex.RLock()
+	current := device.net.transport
+	device.net.mutex.RUnlock()
+	if current == nil || current.Name() != TransportUDP {
+		return
+	}
+
+	tc := &device.transport
+	tc.mutex.Lock()
+	if tc.mode != TransportAuto {
+		tc.mutex.Unlock()
+		return
+	}
+	tc.failures++
+	if tc.failures < TransportFallbackAttempts {
+		tc.mutex.Unlock()
+		return
+	}
+	tc.failures = 0
+	tc.fallback = time.Now()
+	tc.mutex.Unlock()
+
+	logger.Wlog.SaveInfoLog("UDP handshakes keep failing, switching to the stream transport")
+	if peer := device.LookupPeer(); peer != nil {
+		peer.extensions.Reset()
+	}
+	go changeNetwork(device, Endpoint)
+}
+
+func (device *Device) transportSucceeded() {
+	tc := &device.transport
+	tc.mutex.Lock()
+	tc.failures = 0
+	tc.mutex.Unlock()
+}
+
+func (device *Device) dialStream(raddr *net.UDPAddr) (Transport, int, error) {
+	tc := &device.transport
+	tc.mutex.Lock()
+	mode := tc.mode
+	endpoint := tc.streamEndpoint
+	serverName := tc.tlsServerName
+	webSocket := tc.webSocket
+	webSocket.Proxy = tc.proxy
+	tc.mutex.Unlock()
+	if endpoint == "" {
+		endpoint = raddr.String()
+	}
+
+	// the socket is protected before it connects, otherwise the
+	// connection to the server would be routed into the tunnel
+	fd := -1
+	dialer := net.Dialer{
+		Timeout: TransportDialTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(s uintptr) {
+				var protected bool
+				protected, err = protectFd(s)
+				if !protected {
+					fd = int(s) // reported once connected
+				}
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+
+	if mode == TransportWebSocket || (mode == TransportAuto && webSocket.URL != "") {
+		t, err := DialWebSocket(webSocket, &dialer)
+		if err != nil {
+			return nil, -1, err
+		}
+		return t, fd, nil
+	}
+
+	conn, err := dialProxy(&dialer, endpoint, webSocket.Proxy)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	t := &StreamTransport{
+		conn:   conn,
+		local:  conn.LocalAddr(),
+		remote: streamAddr(conn.RemoteAddr()),
+		name:   TransportTCP,
+	}
+	if serverName != "" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+		tlsConn.SetDeadline(time.Now().Add(TransportDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, -1, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		t.conn = tlsConn
+		t.name = "tls"
+	}
+	return t, fd, nil
+}
+
+/* Starts the server side stream listener, an empty address stops it
+ */
+func (device *Device) StartStreamListener(addr string) error {
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	if device.net.listener != nil {
+		device.net.listener.Close()
+		device.net.listener = nil
+	}
+	if addr == "" {
+		return nil
+	}
+
+	tc := &device.transport
+	tc.mutex.Lock()
+	certFile, keyFile := tc.tlsCertFile, tc.tlsKeyFile
+	tc.mutex.Unlock()
+
+	var config *tls.Config
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	listener, err := ListenStream(addr, config)
+	if err != nil {
+		return err
+	}
+	device.net.listener = listener
+	logger.Wlog.SaveInfoLog("stream listener started:" + listener.LocalAddr().String())
+	go device.handleTransport(listener)
+	return nil
+}
+
+func (device *Device) primaryTransport() Transport {
+	device.net.mutex.RLock()
+	defer device.net.mutex.RUnlock()
+	return device.net.transport
+}
+
+func (device *Device) localAddr() string {
+	transport := device.primaryTransport()
+	if transport == nil {
+		return ""
+	}
+	return transport.LocalAddr().String()
+}
+
+/* Reconnects when the stream of the current transport broke
+ */
+func (device *Device) transportClosed(transport Transport) {
+	if transport.Name() == TransportUDP || transport != device.primaryTransport() {
+		return
+	}
+	select {
+	case <-device.signal.stop:
+		return
+	case <-time.After(time.Second * 2):
+	}
+	if transport == device.primaryTransport() {
+		changeNetwork(device, Endpoint)
+	}
+}
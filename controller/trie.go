@@ -18,11 +18,22 @@ import (
  * TODO: Better commenting
  */
 
+/* Owners of the routes, a route is only replaced by a route of
+ * the same or a stronger (lower) source and only removed by its owner
+ */
+const (
+	RouteSourceConfig = iota // include / exclude lists
+	RouteSourcePeer          // inner addresses requested by the peer
+	RouteSourceDNS           // addresses resolved for the route domains
+)
+
 type Trie struct {
-	cidr  uint
-	child [2]*Trie
-	bits  []byte
-	peer  *Peer
+	cidr    uint
+	child   [2]*Trie
+	bits    []byte
+	peer    *Peer
+	exclude bool // prefix is excluded from the tunnel (overrides shorter prefixes)
+	source  int  // owner of the route, see RouteSource*
 
 	// index of "branching" bit
 
@@ -94,7 +105,7 @@ func (node *Trie) RemovePeer(p *Peer) *Trie {
 	node.child[0] = node.child[0].RemovePeer(p)
 	node.child[1] = node.child[1].RemovePeer(p)
 
-	if node.peer != p {
+	if node.peer != p || node.exclude {
 		return node
 	}
 
@@ -111,7 +122,22 @@ func (node *Trie) choose(ip net.IP) byte {
 	return (ip[node.bit_at_byte] >> node.bit_at_shift) & 1
 }
 
-func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
+func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer, source int) *Trie {
+	return node.insert(ip, cidr, peer, false, source)
+}
+
+/* Inserts a prefix routed outside the tunnel,
+ * addresses within it are not looked up in shorter prefixes
+ */
+func (node *Trie) InsertExclude(ip net.IP, cidr uint) *Trie {
+	return node.insert(ip, cidr, nil, true, RouteSourceConfig)
+}
+
+func (node *Trie) hasRoute() bool {
+	return node.peer != nil || node.exclude
+}
+
+func (node *Trie) insert(ip net.IP, cidr uint, peer *Peer, exclude bool, source int) *Trie {
 
 	// at leaf
 
@@ -119,6 +145,8 @@ func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
 		return &Trie{
 			bits:         ip,
 			peer:         peer,
+			exclude:      exclude,
+			source:       source,
 			cidr:         cidr,
 			bit_at_byte:  cidr / 8,
 			bit_at_shift: 7 - (cidr % 8),
@@ -130,11 +158,15 @@ func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
 	common := commonBits(node.bits, ip)
 	if node.cidr <= cidr && common >= node.cidr {
 		if node.cidr == cidr {
-			node.peer = peer
+			if !node.hasRoute() || source <= node.source {
+				node.peer = peer
+				node.exclude = exclude
+				node.source = source
+			}
 			return node
 		}
 		bit := node.choose(ip)
-		node.child[bit] = node.child[bit].Insert(ip, cidr, peer)
+		node.child[bit] = node.child[bit].insert(ip, cidr, peer, exclude, source)
 		return node
 	}
 
@@ -143,6 +175,8 @@ func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
 	newNode := &Trie{
 		bits:         ip,
 		peer:         peer,
+		exclude:      exclude,
+		source:       source,
 		cidr:         cidr,
 		bit_at_byte:  cidr / 8,
 		bit_at_shift: 7 - (cidr % 8),
@@ -176,11 +210,20 @@ func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
 }
 
 func (node *Trie) Lookup(ip net.IP) *Peer {
-	var found *Peer
+	found, _ := node.LookupRoute(ip)
+	return found
+}
+
+/* Returns the peer of the longest matching prefix,
+ * excluded is true when that prefix is excluded from the tunnel
+ */
+func (node *Trie) LookupRoute(ip net.IP) (found *Peer, excluded bool) {
 	size := uint(len(ip))
 	for node != nil && commonBits(node.bits, ip) >= node.cidr {
-		if node.peer != nil {
-			found = node.peer
+		if node.exclude {
+			found, excluded = nil, true
+		} else if node.peer != nil {
+			found, excluded = node.peer, false
 		}
 		if node.bit_at_byte == size {
 			break
@@ -188,7 +231,43 @@ func (node *Trie) Lookup(ip net.IP) *Peer {
 		bit := node.choose(ip)
 		node = node.child[bit]
 	}
-	return found
+	return found, excluded
+}
+
+/* Removes the route of exactly the given prefix if owned by source,
+ * inner nodes left without route and with less than two children are pruned
+ */
+func (node *Trie) Remove(ip net.IP, cidr uint, source int) *Trie {
+	if node == nil || commonBits(node.bits, ip) < node.cidr || node.cidr > cidr {
+		return node
+	}
+	if node.cidr == cidr {
+		if !node.hasRoute() || node.source != source {
+			return node
+		}
+		node.peer = nil
+		node.exclude = false
+		return node.prune()
+	}
+	if node.bit_at_byte == uint(len(ip)) {
+		return node
+	}
+	bit := node.choose(ip)
+	node.child[bit] = node.child[bit].Remove(ip, cidr, source)
+	return node.prune()
+}
+
+func (node *Trie) prune() *Trie {
+	if node.hasRoute() {
+		return node
+	}
+	if node.child[0] == nil {
+		return node.child[1]
+	}
+	if node.child[1] == nil {
+		return node.child[0]
+	}
+	return node
 }
 
 func (node *Trie) Count() uint {
@@ -1,8 +1,7 @@
 package controller
 
 import (
-	"golang.org/x/sys/windows"
-	"unsafe"
+	"sync/atomic"
 )
 
 const (
@@ -10,42 +9,78 @@ const (
 )
 
 type NativeTun struct {
-	fd     int
-	name   string
-	errors chan error // async error handling
+	fd      int
+	name    string
+	mtu     int32      // accessed atomically
+	framing int32      // packet information header, see tun_framing.go
+	errors  chan error // async error handling
+
+	coalescer     *tcpCoalescer // set when the TUN was opened with offloads
+	offloadBuffer []byte
 }
 
 func (tun *NativeTun) MTU() (int, error) {
+	if mtu := atomic.LoadInt32(&tun.mtu); mtu > 0 {
+		return int(mtu), nil
+	}
 	return DefaultMTU, nil
 }
 
-func (tun *NativeTun) Write(d []byte) (int, error) {
-	if IsiOS {
-		var b = make([]byte, 0, len(d)+4)
-		b = append(b, []byte{0, 0, 0, 2}...)
-		b = append(b, d...)
-		d = b
+func (tun *NativeTun) SetMTU(mtu int) {
+	atomic.StoreInt32(&tun.mtu, int32(mtu))
+}
+
+/* Writes the packet at buffer[offset:],
+ * the framing header goes into the headroom before offset
+ */
+func (tun *NativeTun) Write(buffer []byte, offset int) (int, error) {
+	if tun.coalescer != nil {
+		return len(buffer) - offset, tun.coalescer.WriteSingle(buffer[offset:])
 	}
 
-	return windows.Write(windows.Handle(uintptr(unsafe.Pointer(&tun.fd))), d)
+	size := tun.headerSize()
+	if offset < size {
+		return 0, errNoHeadroom
+	}
+	start := offset - size
+	if size > 0 {
+		if err := tun.putHeader(buffer[start:offset], buffer[offset:]); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := tun.write(buffer[start:])
+	if n > size {
+		n -= size
+	} else {
+		n = 0
+	}
+	return n, err
 }
 
-func (tun *NativeTun) Read(d []byte) ([]byte, error) {
-	offset := 0
-	if IsiOS {
-		offset = 4
+/* Reads a packet to buffer[offset:],
+ * the framing header is read into the headroom before offset
+ */
+func (tun *NativeTun) Read(buffer []byte, offset int) ([]byte, error) {
+	size := tun.headerSize()
+	if offset < size {
+		return nil, errNoHeadroom
 	}
+	start := offset - size
 
 	select {
 	case err := <-tun.errors:
 		return nil, err
 	default:
-		n, err := windows.Read(windows.Handle(uintptr(unsafe.Pointer(&tun.fd))), d)
+		n, err := tun.read(buffer[start:])
 		if err != nil || n == 0 {
 			return nil, err
 		}
+		if n <= size || !tun.checkHeader(buffer[start:offset]) {
+			return buffer[offset:offset], nil
+		}
 
-		return d[offset:n], nil
+		return buffer[offset : start+n], nil
 	}
 }
 
@@ -54,12 +89,14 @@ func (tun *NativeTun) Close() error {
 }
 
 func CreateTUN(fd int) (*NativeTun, error) {
-	//windows.SetNonblock(fd, false)
-
 	device := &NativeTun{
 		fd:     fd,
 		errors: make(chan error, 5),
 	}
+	if IsiOS {
+		device.framing = tunFramingUTUN
+	}
+	device.enableOffload()
 
 	return device, nil
 }
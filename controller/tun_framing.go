@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Packet information framing of the TUN
+ *
+ * utun (iOS, macOS) prefixes every packet with its address family
+ * as 4 bytes in network order, a Linux TUN opened without IFF_NO_PI
+ * with struct tun_pi (flags and ethertype). The header is written into
+ * the headroom reserved before the packet in the message buffer.
+ */
+
+const (
+	TunFramingNone       = "none"
+	TunFramingUTUN       = "utun"
+	TunFramingPI         = "pi"
+	TunFramingHeaderSize = 4
+)
+
+const (
+	tunFramingNone = iota
+	tunFramingUTUN
+	tunFramingPI
+)
+
+const (
+	afInetDarwin  = 2
+	afInet6Darwin = 30
+	ethPIPv4      = 0x0800
+	ethPIPv6      = 0x86dd
+	tunPIStrip    = 0x0001 // packet was truncated
+)
+
+var errNoHeadroom = errors.New("no headroom for the packet information header")
+
+func (tun *NativeTun) SetFraming(framing string) error {
+	var mode int32
+	switch framing {
+	case TunFramingNone:
+		mode = tunFramingNone
+	case TunFramingUTUN:
+		mode = tunFramingUTUN
+	case TunFramingPI:
+		mode = tunFramingPI
+	default:
+		return errors.New("invalid TUN framing: " + framing)
+	}
+	atomic.StoreInt32(&tun.framing, mode)
+	return nil
+}
+
+func (tun *NativeTun) headerSize() int {
+	if atomic.LoadInt32(&tun.framing) == tunFramingNone {
+		return 0
+	}
+	return TunFramingHeaderSize
+}
+
+/* Fills the header for packet, by the IP version of the packet
+ */
+func (tun *NativeTun) putHeader(header []byte, packet []byte) error {
+	if len(packet) == 0 {
+		return errors.New("empty packet")
+	}
+	version := int(packet[0] >> 4)
+	if version != ipv4.Version && version != ipv6.Version {
+		return errors.New("unknown IP version")
+	}
+
+	switch atomic.LoadInt32(&tun.framing) {
+	case tunFramingUTUN:
+		family := uint32(afInetDarwin)
+		if version == ipv6.Version {
+			family = afInet6Darwin
+		}
+		binary.BigEndian.PutUint32(header, family)
+	case tunFramingPI:
+		protocol := uint16(ethPIPv4)
+		if version == ipv6.Version {
+			protocol = ethPIPv6
+		}
+		binary.BigEndian.PutUint16(header[0:2], 0)
+		binary.BigEndian.PutUint16(header[2:4], protocol)
+	}
+	return nil
+}
+
+/* Reports whether the packet following header may be used
+ */
+func (tun *NativeTun) checkHeader(header []byte) bool {
+	if atomic.LoadInt32(&tun.framing) == tunFramingPI {
+		return binary.BigEndian.Uint16(header[0:2])&tunPIStrip == 0
+	}
+	return true
+}
+
+func (device *Device) SetTunFraming(framing string) error {
+	return device.tun.device.SetFraming(framing)
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package controller
+
+import (
+	"errors"
+)
+
+var errOffloadUnsupported = errors.New("TUN offloads are only supported on Linux")
+
+func tunOffloadSupported(fd int) bool {
+	return false
+}
+
+func tunRead(fd int, b []byte) (int, error) {
+	return 0, errOffloadUnsupported
+}
+
+func tunWrite(fd int, b []byte) (int, error) {
+	return 0, errOffloadUnsupported
+}
+
+func CreateTUNOffload(name string) (*NativeTun, error) {
+	return nil, errOffloadUnsupported
+}
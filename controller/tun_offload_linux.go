@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tunOffloadCsum = 0x01 // TUN_F_CSUM
+	tunOffloadTSO4 = 0x02 // TUN_F_TSO4
+	tunOffloadTSO6 = 0x04 // TUN_F_TSO6
+	ifReqSize      = 40
+)
+
+func tunIoctl(fd int, request uintptr, arg uintptr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+/* Reports whether the TUN was opened with IFF_VNET_HDR (and IFF_NO_PI),
+ * and enables checksum and TCP segmentation offload if so
+ */
+func tunOffloadSupported(fd int) bool {
+	var ifr [ifReqSize]byte
+	if err := tunIoctl(fd, unix.TUNGETIFF, uintptr(unsafe.Pointer(&ifr[0]))); err != nil {
+		return false
+	}
+	flags := *(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))
+	if flags&unix.IFF_VNET_HDR == 0 || flags&unix.IFF_NO_PI == 0 {
+		return false
+	}
+
+	size := int32(VirtioNetHdrSize)
+	if err := tunIoctl(fd, unix.TUNSETVNETHDRSZ, uintptr(unsafe.Pointer(&size))); err != nil {
+		return false
+	}
+	return tunIoctl(fd, unix.TUNSETOFFLOAD, tunOffloadCsum|tunOffloadTSO4|tunOffloadTSO6) == nil
+}
+
+func tunRead(fd int, b []byte) (int, error) {
+	return unix.Read(fd, b)
+}
+
+func tunWrite(fd int, b []byte) (int, error) {
+	return unix.Write(fd, b)
+}
+
+/* Opens the TUN interface name with offloads,
+ * for Linux desktops and gateways creating the interface themselves
+ */
+func CreateTUNOffload(name string) (*NativeTun, error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, errors.New("interface name too long")
+	}
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifr [ifReqSize]byte
+	copy(ifr[:], name)
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR
+	if err := tunIoctl(fd, unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr[0]))); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return CreateTUN(fd)
+}
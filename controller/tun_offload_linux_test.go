@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package controller
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Returns a TUN with offloads on one end of a packet socket pair
+ * and the other end, playing the kernel side
+ */
+func testOffloadTUN(t *testing.T) (*NativeTun, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := fds[0]
+	tun := &NativeTun{
+		fd:            fd,
+		errors:        make(chan error, 5),
+		offloadBuffer: make([]byte, OffloadBufferSize),
+		coalescer: &tcpCoalescer{
+			write: func(b []byte) (int, error) {
+				return tunWrite(fd, b)
+			},
+		},
+	}
+	return tun, fds[1]
+}
+
+func TestReadOffloadTUNPacketTooBig(t *testing.T) {
+	tun, kernel := testOffloadTUN(t)
+	defer unix.Close(kernel)
+
+	device := newTestDevice(1280)
+	device.tun.device = tun
+	done := make(chan struct{})
+	go func() {
+		device.readOffloadTUN()
+		close(done)
+	}()
+
+	// a packet without GSO larger than the MTU
+	packet := testSegment{id: 1, seq: 1, flags: TCPFlagACK, payload: testPayload(1400)}.build()
+	message := append(make([]byte, VirtioNetHdrSize), packet...)
+	if _, err := unix.Write(kernel, message); err != nil {
+		t.Fatal(err)
+	}
+
+	unix.SetsockoptTimeval(kernel, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 5})
+	reply := make([]byte, OffloadBufferSize)
+	n, err := unix.Read(kernel, reply)
+	if err != nil {
+		t.Fatal("no ICMP error written: ", err)
+	}
+	icmp := reply[VirtioNetHdrSize+20 : n]
+	if icmp[0] != icmpv4DestUnreachable || icmp[1] != icmpv4FragNeeded {
+		t.Errorf("ICMP type %d code %d, want fragmentation needed", icmp[0], icmp[1])
+	}
+	if mtu := binary.BigEndian.Uint16(icmp[6:]); mtu != 1280 {
+		t.Errorf("next hop MTU %d, want 1280", mtu)
+	}
+	if len(device.queue.encryption) != 0 || device.memory.InFlight() != 0 {
+		t.Error("oversized packet queued")
+	}
+
+	close(device.signal.stop)
+	unix.Shutdown(kernel, unix.SHUT_RDWR)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("reader did not stop")
+	}
+	unix.Close(tun.fd)
+}
+
+func TestCreateTUNOffload(t *testing.T) {
+	tun, err := CreateTUNOffload("bttest0")
+	if err != nil {
+		t.Skip("cannot create a TUN interface: ", err)
+	}
+	defer unix.Close(tun.fd)
+	if tun.coalescer == nil || tun.offloadBuffer == nil {
+		t.Error("offloads not enabled on an IFF_VNET_HDR TUN")
+	}
+
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	var ifr [ifReqSize]byte
+	copy(ifr[:], "bttest1")
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = unix.IFF_TUN | unix.IFF_NO_PI
+	if err := tunIoctl(fd, unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr[0]))); err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := CreateTUN(fd)
+	if plain.coalescer != nil {
+		t.Error("offloads enabled on a TUN without IFF_VNET_HDR")
+	}
+}
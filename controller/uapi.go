@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 func SetOperation(device *Device, values []string) string {
@@ -71,17 +72,26 @@ func SetOperation(device *Device, values []string) string {
 				return "Failed to set udp conn:" + err.Error()
 			}
 
-			go sendFd(fd)
+			if fd >= 0 {
+				go sendFd(fd)
+			}
+		case "allowed_ip", "include_ip":
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return "Failed to set " + key + ":" + err.Error()
+			}
 
-			peer.device.net.conn = device.net.conn
-		case "allowed_ip":
+			if peer == nil {
+				peer = device.peers
+			}
+			device.routingTable.Include(network, peer)
+		case "exclude_ip":
 			_, network, err := net.ParseCIDR(value)
 			if err != nil {
-				return "Failed to set allowed_ip:" + err.Error()
+				return "Failed to set exclude_ip:" + err.Error()
 			}
 
-			ones, _ := network.Mask.Size()
-			device.routingTable.Insert(network.IP, uint(ones), peer)
+			device.routingTable.Exclude(network)
 		case "persistent_keepalive_interval":
 			// update keep-alive interval
 			secs, err := strconv.ParseUint(value, 10, 16)
@@ -102,10 +112,179 @@ func SetOperation(device *Device, values []string) string {
 				}
 				peer.SendKeepAlive()
 			}
+		case "route_domain":
+			device.domainRoutes.AddPattern(value)
+		case "bypass_file":
+			err := device.LoadBypass(value)
+			if err != nil {
+				return "Failed to set bypass_file:" + err.Error()
+			}
+		case "mtu":
+			mtu, err := strconv.Atoi(value)
+			if err != nil {
+				return "Failed to set mtu:" + err.Error()
+			}
+			err = device.SetMTU(mtu)
+			if err != nil {
+				return "Failed to set mtu:" + err.Error()
+			}
+		case "workers":
+			workers, err := strconv.Atoi(value)
+			if err == nil {
+				err = device.SetWorkers(workers)
+			}
+			if err != nil {
+				return "Failed to set workers:" + err.Error()
+			}
+		case "tun_framing":
+			if err := device.SetTunFraming(value); err != nil {
+				return "Failed to set TUN framing:" + err.Error()
+			}
+		case "memory_budget":
+			megabytes, err := strconv.Atoi(value)
+			if err == nil {
+				err = device.SetMemoryBudget(megabytes)
+			}
+			if err != nil {
+				return "Failed to set memory budget:" + err.Error()
+			}
+		case "queue_outbound_size", "queue_inbound_size", "queue_handshake_size":
+			queue := QueueOutbound
+			if key == "queue_inbound_size" {
+				queue = QueueInbound
+			} else if key == "queue_handshake_size" {
+				queue = QueueHandshake
+			}
+			size, err := strconv.Atoi(value)
+			if err == nil {
+				err = device.SetQueueSize(queue, size)
+			}
+			if err != nil {
+				return "Failed to set " + key + ":" + err.Error()
+			}
+		case "pmtu_discovery":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return "Failed to set pmtu_discovery:" + err.Error()
+			}
+			device.pmtu.enabled.Set(enabled)
+		case "mss_clamp":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return "Failed to set mss_clamp:" + err.Error()
+			}
+			device.mssClamp.Set(enabled)
+		case "kill_switch":
+			if err := device.killSwitch.SetMode(value); err != nil {
+				return "Failed to set kill_switch:" + err.Error()
+			}
+		case "kill_switch_max_age":
+			secs, err := strconv.Atoi(value)
+			if err == nil {
+				err = device.killSwitch.SetMaxAge(time.Duration(secs) * time.Second)
+			}
+			if err != nil {
+				return "Failed to set kill_switch_max_age:" + err.Error()
+			}
+		case "dns_leak_protection":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return "Failed to set dns_leak_protection:" + err.Error()
+			}
+			device.killSwitch.dnsLeak.Set(enabled)
+		case "tunnel_dns":
+			if err := device.killSwitch.SetDNSServers(value); err != nil {
+				return "Failed to set tunnel_dns:" + err.Error()
+			}
+		case "firewall_rule":
+			if err := device.firewall.Add(value); err != nil {
+				return "Failed to set firewall_rule:" + err.Error()
+			}
+		case "firewall_clear":
+			clear, err := strconv.ParseBool(value)
+			if err != nil {
+				return "Failed to set firewall_clear:" + err.Error()
+			}
+			if clear {
+				device.firewall.Clear()
+			}
+		case "flow_tracking":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return "Failed to set flow_tracking:" + err.Error()
+			}
+			device.flows.SetEnabled(enabled)
+		case "handshake_layout":
+			if err := device.SetHandshakeLayout(value); err != nil {
+				return "Failed to set handshake_layout:" + err.Error()
+			}
+		case "obfuscation_key":
+			err := device.obfuscation.SetKey(value)
+			if err != nil {
+				return "Failed to set obfuscation_key:" + err.Error()
+			}
+		case "obfuscation_padding":
+			padding, err := strconv.Atoi(value)
+			if err == nil {
+				err = device.obfuscation.SetPadding(padding)
+			}
+			if err != nil {
+				return "Failed to set obfuscation_padding:" + err.Error()
+			}
+		case "obfuscation_junk":
+			junk, err := strconv.Atoi(value)
+			if err == nil {
+				err = device.obfuscation.SetJunk(junk)
+			}
+			if err != nil {
+				return "Failed to set obfuscation_junk:" + err.Error()
+			}
+		case "transport":
+			err := device.SetTransport(value)
+			if err != nil {
+				return "Failed to set transport:" + err.Error()
+			}
+		case "tcp_endpoint":
+			if _, _, err := net.SplitHostPort(value); err != nil && value != "" {
+				return "Failed to set tcp_endpoint:" + err.Error()
+			}
+			device.transport.SetStreamEndpoint(value)
+		case "ws_url":
+			device.transport.SetWebSocketURL(value)
+		case "ws_host":
+			device.transport.SetWebSocketHost(value)
+		case "proxy_url":
+			device.transport.SetProxy(value)
+		case "tls_server_name":
+			device.transport.SetTLSServerName(value)
+		case "tls_cert_file":
+			device.transport.SetListenerCertificate(value, "")
+		case "tls_key_file":
+			device.transport.SetListenerCertificate("", value)
+		case "stream_listen":
+			err := device.StartStreamListener(value)
+			if err != nil {
+				return "Failed to set stream_listen:" + err.Error()
+			}
+		case "metrics_listen":
+			if value == "" {
+				device.StopMetrics()
+				break
+			}
+			err := device.StartMetrics(value)
+			if err != nil {
+				return "Failed to set metrics_listen:" + err.Error()
+			}
 		default:
 			return "Invalid UAPI key (device configuration):" + v
 		}
 	}
 
+	// without tunnel DNS servers every DNS packet would be dropped
+	if device.killSwitch.dnsLeak.Get() && !device.killSwitch.hasDNSServers() {
+		device.killSwitch.dnsLeak.Set(false)
+		return "Failed to set dns_leak_protection: tunnel_dns is empty"
+	}
+
 	return ""
 }
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package controller
+
+import (
+	"net"
+)
+
+// function to get fd
+func GetFD(conn *net.UDPConn) int {
+	fd := -1
+	if raw, err := conn.SyscallConn(); err == nil {
+		raw.Control(func(sysfd uintptr) {
+			fd = int(sysfd)
+		})
+	}
+	return fd
+}
@@ -0,0 +1,237 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+/* WebSocket transport
+ *
+ * Carries the framed message stream of the stream transport
+ * in binary WebSocket messages, so it can pass CDNs and HTTP proxies.
+ * The Host header may differ from the host of the URL (domain fronting),
+ * the connection can go through an HTTP (CONNECT) or SOCKS5 proxy.
+ *
+ * A server accepts the transport by serving NewWebSocketListener() over HTTP.
+ */
+
+const (
+	TransportWebSocket = "websocket"
+)
+
+type WebSocketConfig struct {
+	URL   string // ws:// or wss:// URL of the server
+	Host  string // Host header, defaults to the host of the URL
+	Proxy string // http://, https:// or socks5:// proxy URL, may be empty
+}
+
+/* Dials addr, through the proxy if any
+ */
+func dialProxy(forward *net.Dialer, addr string, proxyURL string) (net.Conn, error) {
+	if proxyURL == "" {
+		return forward.Dial("tcp", addr)
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return dialConnectProxy(forward, u, addr)
+	default:
+		dialer, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", addr)
+	}
+}
+
+/* Opens a tunnel to addr through an HTTP proxy
+ */
+func dialConnectProxy(forward *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	conn, err := forward.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	conn.SetDeadline(time.Now().Add(TransportDialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("proxy CONNECT failed: " + resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was established")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+/* Opens a WebSocket transport,
+ * forward dials the TCP connections (nil for a plain dialer)
+ */
+func DialWebSocket(config WebSocketConfig, forward *net.Dialer) (*StreamTransport, error) {
+	if forward == nil {
+		forward = &net.Dialer{Timeout: TransportDialTimeout}
+	}
+
+	location, err := url.ParseRequestURI(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme != "ws" && location.Scheme != "wss" {
+		return nil, errors.New("invalid websocket URL: " + config.URL)
+	}
+
+	addr := location.Host
+	if location.Port() == "" {
+		if location.Scheme == "wss" {
+			addr = net.JoinHostPort(location.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(location.Hostname(), "80")
+		}
+	}
+
+	conn, err := dialProxy(forward, addr, config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr()
+	remote := streamAddr(conn.RemoteAddr())
+
+	if location.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: location.Hostname()})
+		tlsConn.SetDeadline(time.Now().Add(TransportDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	// the handshake writes the Host header from the location
+
+	scheme := "http"
+	if location.Scheme == "wss" {
+		scheme = "https"
+	}
+	origin := scheme + "://" + location.Host + "/"
+	wsConfig, err := websocket.NewConfig(location.String(), origin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if config.Host != "" {
+		wsConfig.Location.Host = config.Host
+		wsConfig.Origin.Host = config.Host
+	}
+
+	conn.SetDeadline(time.Now().Add(TransportDialTimeout))
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+
+	return &StreamTransport{
+		conn:   ws,
+		local:  local,
+		remote: remote,
+		name:   TransportWebSocket,
+	}, nil
+}
+
+/* Returns a stream listener fed by WebSocket connections,
+ * serve it with http.Handle (e.g. behind a CDN or reverse proxy)
+ */
+func NewWebSocketListener() *StreamListener {
+	return newStreamListener(nil, TransportWebSocket)
+}
+
+func (sl *StreamListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handler: sl.handleWebSocket}.ServeHTTP(w, r)
+}
+
+func (sl *StreamListener) handleWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	addr := ws.Request().RemoteAddr
+	source, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+
+	sc := &streamConn{conn: ws}
+	if !sl.add(source.String(), sc) {
+		return
+	}
+	sl.serve(sc, source.String(), source)
+}
+
+/* Returns the handler accepting the WebSocket transport on the server side,
+ * e.g. http.Handle("/tunnel", device.WebSocketHandler())
+ */
+func (device *Device) WebSocketHandler() http.Handler {
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	if device.net.webSocket == nil {
+		device.net.webSocket = NewWebSocketListener()
+		go device.handleTransport(device.net.webSocket)
+	}
+	return device.net.webSocket
+}
@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* Serves a WebSocket listener echoing every message back to its sender
+ */
+func startEchoWebSocket(handler func(http.Handler) http.Handler) (*httptest.Server, *StreamListener) {
+	listener := NewWebSocketListener()
+	go func() {
+		buffer := make([]byte, MaxMessageSize)
+		for {
+			n, source, err := listener.Receive(buffer)
+			if err != nil {
+				return
+			}
+			listener.SendTo(buffer[:n], source)
+		}
+	}()
+
+	var h http.Handler = listener
+	if handler != nil {
+		h = handler(h)
+	}
+	return httptest.NewServer(h), listener
+}
+
+/* Starts an HTTP proxy accepting CONNECT with the credentials user:pass
+ */
+func startConnectProxy(tunnels *int32) *httptest.Server {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	return proxy
+}
+
+func checkRoundTrip(t *testing.T, transport Transport) {
+	transport.(*StreamTransport).conn.SetDeadline(time.Now().Add(time.Second * 5))
+	buffer := make([]byte, MaxMessageSize)
+	for _, size := range []int{1, 148, 1420, MaxMessageSize - 64} {
+		message := bytes.Repeat([]byte{byte(size)}, size)
+		if _, err := transport.Send(message); err != nil {
+			t.Fatalf("send %d bytes: %v", size, err)
+		}
+		n, _, err := transport.Receive(buffer)
+		if err != nil {
+			t.Fatalf("receive %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(buffer[:n], message) {
+			t.Fatalf("message of %d bytes came back as %d bytes", size, n)
+		}
+	}
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	server, listener := startEchoWebSocket(nil)
+	defer listener.Close()
+	defer server.Close()
+
+	transport, err := DialWebSocket(WebSocketConfig{URL: "ws://" + server.Listener.Addr().String() + "/tunnel"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if transport.Name() != TransportWebSocket {
+		t.Errorf("name = %q, want %q", transport.Name(), TransportWebSocket)
+	}
+	checkRoundTrip(t, transport)
+}
+
+func TestWebSocketHostHeader(t *testing.T) {
+	var host atomic.Value
+	server, listener := startEchoWebSocket(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host.Store(r.Host)
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer listener.Close()
+	defer server.Close()
+
+	config := WebSocketConfig{
+		URL:  "ws://" + server.Listener.Addr().String() + "/tunnel",
+		Host: "cdn.example.com",
+	}
+	transport, err := DialWebSocket(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if got := host.Load(); got != config.Host {
+		t.Errorf("Host header = %v, want %q", got, config.Host)
+	}
+	checkRoundTrip(t, transport)
+}
+
+func TestWebSocketConnectProxy(t *testing.T) {
+	server, listener := startEchoWebSocket(nil)
+	defer listener.Close()
+	defer server.Close()
+	var tunnels int32
+	proxy := startConnectProxy(&tunnels)
+	defer proxy.Close()
+
+	config := WebSocketConfig{
+		URL:   "ws://" + server.Listener.Addr().String() + "/tunnel",
+		Proxy: "http://user:pass@" + proxy.Listener.Addr().String(),
+	}
+	transport, err := DialWebSocket(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if n := atomic.LoadInt32(&tunnels); n != 1 {
+		t.Fatalf("%d tunnels through the proxy, want 1", n)
+	}
+	checkRoundTrip(t, transport)
+}
+
+func TestWebSocketConnectProxyRejected(t *testing.T) {
+	server, listener := startEchoWebSocket(nil)
+	defer listener.Close()
+	defer server.Close()
+	var tunnels int32
+	proxy := startConnectProxy(&tunnels)
+	defer proxy.Close()
+
+	config := WebSocketConfig{
+		URL:   "ws://" + server.Listener.Addr().String() + "/tunnel",
+		Proxy: "http://user:wrong@" + proxy.Listener.Addr().String(),
+	}
+	if transport, err := DialWebSocket(config, nil); err == nil {
+		transport.Close()
+		t.Fatal("dial succeeded with wrong proxy credentials")
+	}
+}
+
+func TestWebSocketInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "http://example.com/", "example.com:80"} {
+		if _, err := DialWebSocket(WebSocketConfig{URL: u}, nil); err == nil {
+			t.Errorf("DialWebSocket(%q) succeeded", u)
+		}
+	}
+}
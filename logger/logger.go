@@ -43,7 +43,7 @@ func (w *Wlogger) Close() {
 func (w *Wlogger) SaveInfoLog(msg string) {
 	if Wlog != nil {
 		now := time.Now().Local().Format("2006-01-02 15:04:05")
-		wmsg := now + " [I] " + msg + "\n"
+		wmsg := now + " [I] " + Redact(msg) + "\n"
 
 		w.Lock()
 		defer w.Unlock()
@@ -56,7 +56,7 @@ func (w *Wlogger) SaveInfoLog(msg string) {
 func (w *Wlogger) SaveDebugLog(msg string) {
 	if Wlog != nil {
 		now := time.Now().Local().Format("2006-01-02 15:04:05")
-		wmsg := now + " [I] " + msg + "\n"
+		wmsg := now + " [I] " + Redact(msg) + "\n"
 
 		w.Lock()
 		defer w.Unlock()
@@ -69,7 +69,7 @@ func (w *Wlogger) SaveDebugLog(msg string) {
 func (w *Wlogger) SaveErrLog(msg string) {
 	if Wlog != nil {
 		now := time.Now().Local().Format("2006-01-02 15:04:05")
-		wmsg := now + " [I] " + msg + "\n"
+		wmsg := now + " [I] " + Redact(msg) + "\n"
 
 		w.Lock()
 		defer w.Unlock()
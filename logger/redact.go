@@ -0,0 +1,30 @@
+package logger
+
+import (
+	"regexp"
+)
+
+/* Redaction of secrets
+ *
+ * Everything written to the diary goes through Redact, which masks the
+ * values of secret fields (private keys, pre-shared keys, signatures,
+ * tokens, passwords) in JSON config and in UAPI key=value text,
+ * as well as the credentials in URLs.
+ */
+
+const Redacted = "<redacted>"
+
+const secretKey = `[A-Za-z0-9_]*(?:private|preshared|psk|sign|token|secret|password|passwd|obfuscation_key)[A-Za-z0-9_]*`
+
+var (
+	redactJSON     = regexp.MustCompile(`(?i)("` + secretKey + `"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	redactKeyValue = regexp.MustCompile(`(?i)(\b` + secretKey + `=)[^\s,;&"]*`)
+	redactURL      = regexp.MustCompile(`(://)[^/\s@"]+@`)
+)
+
+func Redact(msg string) string {
+	msg = redactJSON.ReplaceAllString(msg, `${1}"`+Redacted+`"`)
+	msg = redactKeyValue.ReplaceAllString(msg, "${1}"+Redacted)
+	msg = redactURL.ReplaceAllString(msg, "${1}"+Redacted+"@")
+	return msg
+}
@@ -9,9 +9,8 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"runtime/debug"
 	"strconv"
-	"syscall"
+	"strings"
 	"time"
 
 	"bt/common"
@@ -19,8 +18,6 @@ import (
 	"bt/logger"
 
 	"golang.org/x/crypto/curve25519"
-	"unsafe"
-	"os"
 )
 
 var (
@@ -36,6 +33,20 @@ type Callback interface {
 	CallDestinationIP(string)
 }
 
+// optional notifications, see SetEventCallback
+type EventCallback interface {
+	CallQuality(string)
+	CallRoutes(string)
+	CallLeak(string)
+}
+
+var events EventCallback
+
+// protects the stream sockets from the VPN routes, see SetProtector
+type Protector interface {
+	Protect(int) bool
+}
+
 /*type Cb struct {
 
 }
@@ -58,18 +69,47 @@ func (c Cb)CallDestinationIP(s string)  {
 }*/
 
 type configData struct {
-	OwnPrivate   string `json:"own_private"`
-	OwnPublic    string `json:"own_public"`
-	TheirPublic  string `json:"their_public"`
-	Endpoint     string `json:"endpoint"`
-	AllowIp      string `json:"allow_ip"`
-	LogPath      string `json:"log_path"`
-	IsIOS        string `json:"is_iOS"`
-	Ts           uint32 `json:"ts"`
-	Sign         string `json:"sign"`
-	Netmask      uint32 `json:"netmask"`
-	IntervalTime int64  `json:"interval_time"`
-	IsCallbackIp int    `json:"is_callback_ip"`
+	OwnPrivate         string `json:"own_private"`
+	OwnPublic          string `json:"own_public"`
+	TheirPublic        string `json:"their_public"`
+	Endpoint           string `json:"endpoint"`
+	AllowIp            string `json:"allow_ip"`
+	LogPath            string `json:"log_path"`
+	IsIOS              string `json:"is_iOS"`
+	Ts                 uint32 `json:"ts"`
+	Sign               string `json:"sign"`
+	Netmask            uint32 `json:"netmask"`
+	IntervalTime       int64  `json:"interval_time"`
+	MetricsListen      string `json:"metrics_listen"`
+	Mtu                int    `json:"mtu"`
+	PmtuDiscovery      int    `json:"pmtu_discovery"`
+	MssClamp           int    `json:"mss_clamp"`
+	Include            string `json:"include"`
+	Exclude            string `json:"exclude"`
+	BypassFile         string `json:"bypass_file"`
+	RouteDomains       string `json:"route_domains"`
+	AllowIp6           string `json:"allow_ip6"`
+	Prefix6            int    `json:"prefix6"`
+	ObfuscationKey     string `json:"obfuscation_key"`
+	ObfuscationPadding int    `json:"obfuscation_padding"`
+	ObfuscationJunk    int    `json:"obfuscation_junk"`
+	Transport          string `json:"transport"`
+	TcpEndpoint        string `json:"tcp_endpoint"`
+	TlsServerName      string `json:"tls_server_name"`
+	WsUrl              string `json:"ws_url"`
+	WsHost             string `json:"ws_host"`
+	ProxyUrl           string `json:"proxy_url"`
+	Workers            int    `json:"workers"`
+	MemoryBudget       int    `json:"memory_budget"`
+	QueueSize          int    `json:"queue_size"`
+	KillSwitch         string `json:"kill_switch"`
+	KillSwitchMaxAge   int    `json:"kill_switch_max_age"`
+	DnsLeakProtection  int    `json:"dns_leak_protection"`
+	TunnelDns          string `json:"tunnel_dns"`
+	Firewall           string `json:"firewall"`
+	FlowTracking       int    `json:"flow_tracking"`
+	HandshakeLayout    string `json:"handshake_layout"`
+	TunFraming         string `json:"tun_framing"`
 }
 
 func main(){
@@ -138,6 +178,21 @@ func main(){
 
 }
 
+//export SetProtector
+func SetProtector(p Protector) {
+	if p == nil {
+		controller.SetProtector(nil)
+		return
+	}
+	controller.SetProtector(p.Protect)
+}
+
+// must be called before Start, nil stops the notifications
+//export SetEventCallback
+func SetEventCallback(cb EventCallback) {
+	events = cb
+}
+
 //export Init
 func Init(fd int, jsonFomt string) string {
 	if fd <= 0 {
@@ -165,13 +220,15 @@ func Init(fd int, jsonFomt string) string {
 	controller.Sign = values.Sign
 	controller.AllowIp = values.AllowIp
 	controller.Netmask = values.Netmask
+	controller.AllowIp6 = values.AllowIp6
+	if values.Prefix6 >= controller.MinInnerPrefix6 && values.Prefix6 <= 128 {
+		controller.Prefix6 = uint8(values.Prefix6)
+	}
 	controller.Endpoint = values.Endpoint
 	if values.IntervalTime > 0 {
 		controller.IntervalTime = values.IntervalTime
 	}
 
-	debug.SetGCPercent(10)
-
 	// open TUN device
 	tun, err := controller.CreateTUN(fd)
 	if err != nil {
@@ -181,13 +238,113 @@ func Init(fd int, jsonFomt string) string {
 
 	// create controller device
 	device = controller.NewDevice(tun)
-	config := make([]string, 6)
+	config := make([]string, 5)
 	config[0] = "own_private=" + values.OwnPrivate
 	config[1] = "own_public=" + values.OwnPublic
 	config[2] = "their_public=" + values.TheirPublic
 	config[3] = "endpoint=" + values.Endpoint
-	config[4] = "allowed_ip=0.0.0.0/0"
-	config[5] = "persistent_keepalive_interval=15"
+	config[4] = "persistent_keepalive_interval=15"
+
+	// the transport must be chosen before the endpoint connects
+	if values.Transport != "" {
+		transport := []string{"transport=" + values.Transport}
+		if values.TcpEndpoint != "" {
+			transport = append(transport, "tcp_endpoint="+values.TcpEndpoint)
+		}
+		if values.TlsServerName != "" {
+			transport = append(transport, "tls_server_name="+values.TlsServerName)
+		}
+		if values.WsUrl != "" {
+			transport = append(transport, "ws_url="+values.WsUrl)
+		}
+		if values.WsHost != "" {
+			transport = append(transport, "ws_host="+values.WsHost)
+		}
+		if values.ProxyUrl != "" {
+			transport = append(transport, "proxy_url="+values.ProxyUrl)
+		}
+		config = append(transport, config...)
+	}
+
+	// split tunneling, everything goes through the tunnel by default
+	// (or only the domains to route, if any), IPv6 too when an IPv6
+	// address is requested, it would bypass the tunnel otherwise
+	include := splitList(values.Include)
+	domains := splitList(values.RouteDomains)
+	if len(include) == 0 && len(domains) == 0 {
+		include = []string{"0.0.0.0/0"}
+		if values.AllowIp6 != "" {
+			include = append(include, "::/0")
+		}
+	}
+	for _, v := range include {
+		config = append(config, "include_ip="+v)
+	}
+	for _, v := range splitList(values.Exclude) {
+		config = append(config, "exclude_ip="+v)
+	}
+	for _, v := range domains {
+		config = append(config, "route_domain="+v)
+	}
+
+	if values.BypassFile != "" {
+		config = append(config, "bypass_file="+values.BypassFile)
+	}
+	if values.Mtu > 0 {
+		config = append(config, "mtu="+strconv.Itoa(values.Mtu))
+	}
+	if values.TunFraming != "" {
+		config = append(config, "tun_framing="+values.TunFraming)
+	}
+	if values.MemoryBudget > 0 {
+		config = append(config, "memory_budget="+strconv.Itoa(values.MemoryBudget))
+	}
+	if values.QueueSize > 0 {
+		size := strconv.Itoa(values.QueueSize)
+		config = append(config, "queue_outbound_size="+size, "queue_inbound_size="+size, "queue_handshake_size="+size)
+	}
+	if values.Workers > 0 {
+		config = append(config, "workers="+strconv.Itoa(values.Workers))
+	}
+	if values.PmtuDiscovery == 1 {
+		config = append(config, "pmtu_discovery=true")
+	}
+	if values.MssClamp == 1 {
+		config = append(config, "mss_clamp=true")
+	}
+	if values.KillSwitch != "" {
+		config = append(config, "kill_switch="+values.KillSwitch)
+	}
+	if values.KillSwitchMaxAge > 0 {
+		config = append(config, "kill_switch_max_age="+strconv.Itoa(values.KillSwitchMaxAge))
+	}
+	if values.TunnelDns != "" {
+		config = append(config, "tunnel_dns="+values.TunnelDns)
+	}
+	if values.DnsLeakProtection == 1 {
+		config = append(config, "dns_leak_protection=true")
+	}
+	for _, v := range splitList(values.Firewall) {
+		config = append(config, "firewall_rule="+v)
+	}
+	if values.FlowTracking == 1 {
+		config = append(config, "flow_tracking=true")
+	}
+	if values.HandshakeLayout != "" {
+		config = append(config, "handshake_layout="+values.HandshakeLayout)
+	}
+	if values.MetricsListen != "" {
+		config = append(config, "metrics_listen="+values.MetricsListen)
+	}
+	if values.ObfuscationKey != "" {
+		if values.ObfuscationPadding > 0 {
+			config = append(config, "obfuscation_padding="+strconv.Itoa(values.ObfuscationPadding))
+		}
+		if values.ObfuscationJunk > 0 {
+			config = append(config, "obfuscation_junk="+strconv.Itoa(values.ObfuscationJunk))
+		}
+		config = append(config, "obfuscation_key="+values.ObfuscationKey)
+	}
 
 	errMsg := controller.SetOperation(device, config)
 	if errMsg != "" {
@@ -225,7 +382,7 @@ func Start(rfd int32, cb Callback) string {
 	p := make([]byte, 1)
 	//windows.Read(windows.Handle(uintptr(unsafe.Pointer(&rfd))), d)
 	//syscall.Read(int(rfd), p)
-	syscall.Read(syscall.Handle(uintptr(unsafe.Pointer(&rfd))), p)
+	controller.ReadPipe(&rfd, p)
 
 	device.Close()
 
@@ -251,16 +408,122 @@ func status(c Callback) {
 			c.CallStatus(n)
 		case fd := <-controller.FdChan:
 			c.CallFd(fd)
+		case s := <-controller.QualityChan:
+			if events != nil {
+				events.CallQuality(s)
+			}
+		case s := <-controller.RoutesChan:
+			if events != nil {
+				events.CallRoutes(s)
+			}
+		case s := <-controller.LeakChan:
+			if events != nil {
+				events.CallLeak(s)
+			}
 			//case n := <-controller.UploadFlowChan:
 			//	c.CallUploadFlow(n)
 			//case n := <-controller.DownloadFlowChan:
 			//	c.CallDownloadFlow(n)
-			//case str := <-controller.DestinationIPChan:
-			//	c.CallDestinationIP(str)
 		}
 	}
 }
 
+//export GetStats
+func GetStats() string {
+	if device == nil {
+		return ""
+	}
+	b, err := json.Marshal(device.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+//export GetTopDestinations
+func GetTopDestinations(n int) string {
+	if device == nil {
+		return ""
+	}
+	b, err := json.Marshal(device.TopDestinations(n))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+//export GetRoutes
+func GetRoutes() string {
+	if device == nil {
+		return ""
+	}
+	routes := device.Routes()
+	list := make([]string, 0, len(routes))
+	for _, v := range routes {
+		list = append(list, v.String())
+	}
+	return strings.Join(list, ",")
+}
+
+//export LookupBypass
+func LookupBypass(ip string) bool {
+	addr := net.ParseIP(ip)
+	if device == nil || addr == nil {
+		return false
+	}
+	return device.LookupBypass(addr)
+}
+
+//export ReloadBypass
+func ReloadBypass() string {
+	if device == nil {
+		return "device not initialized"
+	}
+	err := device.ReloadBypass()
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+//export SetConfig
+func SetConfig(config string) string {
+	if device == nil {
+		return "device not initialized"
+	}
+	var lines []string
+	for _, v := range strings.Split(config, "\n") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			lines = append(lines, v)
+		}
+	}
+	return controller.SetOperation(device, lines)
+}
+
+//export StartCapture
+func StartCapture(path string, maxSize int) string {
+	if device == nil {
+		return "device not initialized"
+	}
+	err := device.StartCapture(path, int64(maxSize))
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+//export StopCapture
+func StopCapture() string {
+	if device == nil {
+		return "device not initialized"
+	}
+	err := device.StopCapture()
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
 
 //export GetPriAndPubKey
 func GetPriAndPubKey() (string,string) {
@@ -269,9 +532,8 @@ func GetPriAndPubKey() (string,string) {
 	var pri, pub [32]byte
 	_, err := io.ReadFull(random, pri[:])
 	if err != nil {
-		fmt.Println("Error:",err)
-		return "",""
-		os.Exit(1)
+		logger.Wlog.SaveErrLog("Failed to generate private key:" + err.Error())
+		return "", ""
 	}
 
 	pri[0] &= 248
@@ -283,9 +545,7 @@ func GetPriAndPubKey() (string,string) {
 	private := base64.StdEncoding.EncodeToString(pri[:])
 	public := base64.StdEncoding.EncodeToString(pub[:])
 
-	//return private + "," + public
-	fmt.Println(private + "," + public)
-	return private,public
+	return private, public
 }
 
 //export GetDomain
@@ -335,6 +595,17 @@ L:
 	return string(v)
 }
 
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func f(){
 	udp_addr, err := net.ResolveUDPAddr("udp", ":11110")
 	if err != nil{